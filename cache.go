@@ -0,0 +1,169 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"dhcpdb"
+	"utils"
+)
+
+// Binding cached by the handler
+type lease struct {
+	ip     string
+	nic    net.HardwareAddr // Client's CHAddr
+	expiry time.Time        // When the cached entry stops being trusted
+	end    time.Time        // When the lease ends, zero for infinite leases
+}
+
+/*
+Bounded LRU cache of the recent bindings, letting the handler validate the
+renewals of known clients without reading the binding from the store. Entries
+are trusted up to their expiry at most, so a missed invalidation only delays
+the detection of a change made by another replica. Untrusted entries are kept
+until evicted or invalidated: while Redis is unreachable they are the last
+known binding of the address.
+*/
+type leaseCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List // most recently used first
+	entries map[string]*list.Element
+}
+
+func newLeaseCache(size int, ttl time.Duration) *leaseCache {
+	return &leaseCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element, size),
+	}
+}
+
+// Returns the hardware address bound to the address, false if not cached
+func (c *leaseCache) get(ipAddr net.IP) (net.HardwareAddr, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[ipAddr.String()]
+	if !ok {
+		return nil, false
+	}
+
+	l := elem.Value.(*lease)
+	if time.Now().After(l.expiry) {
+		return nil, false
+	}
+
+	c.order.MoveToFront(elem)
+	return l.nic, true
+}
+
+// Returns the last hardware address known to be bound to the address, trusted
+// or not, false if not cached or if the lease has ended
+func (c *leaseCache) lastKnown(ipAddr net.IP) (net.HardwareAddr, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[ipAddr.String()]
+	if !ok {
+		return nil, false
+	}
+
+	l := elem.Value.(*lease)
+	if !l.end.IsZero() && time.Now().After(l.end) {
+		return nil, false
+	}
+	return l.nic, true
+}
+
+// Caches the binding for leaseTime, bounded by the cache time to live
+func (c *leaseCache) put(ipAddr net.IP, hwAddr net.HardwareAddr, leaseTime time.Duration) {
+	now := time.Now()
+	l := &lease{ip: ipAddr.String(), nic: hwAddr}
+	if leaseTime > 0 {
+		l.end = now.Add(leaseTime)
+	}
+	if leaseTime <= 0 || leaseTime > c.ttl {
+		leaseTime = c.ttl
+	}
+	l.expiry = now.Add(leaseTime)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[l.ip]; ok {
+		elem.Value = l
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[l.ip] = c.order.PushFront(l)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lease).ip)
+	}
+}
+
+func (c *leaseCache) invalidate(ip string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[ip]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, ip)
+	}
+}
+
+// Stops trusting all the entries, keeping them as last known bindings
+func (c *leaseCache) distrust() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for elem := c.order.Front(); elem != nil; elem = elem.Next() {
+		elem.Value.(*lease).expiry = time.Time{}
+	}
+}
+
+/*
+Invalidates the entries changed by other replicas until the context is
+cancelled. The subscription is retried with exponential backoff when it
+fails, the entries being distrusted since the events published in the
+meanwhile are lost.
+*/
+func (c *leaseCache) follow(ctx context.Context, sc *dhcpdb.SharedContext) {
+	const maxBackoff = time.Minute
+	backoff := time.Second
+
+	for {
+		start := time.Now()
+		err := sc.SubscribeEvents(ctx, func(event *dhcpdb.LeaseEvent) {
+			if event.Origin != sc.ReplicaID() {
+				c.invalidate(event.IP)
+			}
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		c.distrust()
+
+		if time.Since(start) > maxBackoff {
+			backoff = time.Second
+		}
+		utils.Log.Printf("Lease events subscription ended (%v), retrying in %s\n", err, backoff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"dhcpdb"
+	"utils"
+)
+
+const (
+	CMD_GROW     = "grow"
+	CMD_SHRINK   = "shrink"
+	CMD_RENUMBER = "renumber"
+	CMD_FINALIZE = "finalize"
+	CMD_USAGE    = "usage"
+	CMD_FSCK     = "fsck"
+	CMD_HISTORY  = "history"
+	CMD_WHO_HAD  = "whohad"
+	CMD_EXPORT   = "export"
+	CMD_IMPORT   = "import"
+	CMD_SNAPSHOT = "snapshot"
+	CMD_RESTORE  = "restore"
+)
+
+/*
+Runs an administrative command on the shared pool instead of serving DHCP
+requests, and returns its outcome as the function result.
+*/
+func runCommand(ctx context.Context, sc *dhcpdb.SharedContext, audit *dhcpdb.AuditLog, obj map[string]interface{}, cmd string) map[string]interface{} {
+	res := make(map[string]interface{})
+
+	var err error
+	switch cmd {
+	case CMD_GROW:
+		var r dhcpdb.IPRange
+		if r, err = dhcpdb.ParseIPRange(getStringParam(obj, "range", "")); err == nil {
+			err = sc.GrowPool(ctx, r)
+		}
+	case CMD_SHRINK:
+		var r dhcpdb.IPRange
+		if r, err = dhcpdb.ParseIPRange(getStringParam(obj, "range", "")); err == nil {
+			drain := time.Duration(getIntParam(obj, "drainSeconds", 3600)) * time.Second
+			err = sc.ShrinkPool(ctx, r, time.Now().Add(drain))
+		}
+	case CMD_RENUMBER:
+		var from, to dhcpdb.IPRange
+		if from, err = dhcpdb.ParseIPRange(getStringParam(obj, "from", "")); err == nil {
+			if to, err = dhcpdb.ParseIPRange(getStringParam(obj, "to", "")); err == nil {
+				err = sc.RenumberPool(ctx, from, to)
+			}
+		}
+	case CMD_FINALIZE:
+		var finalized []dhcpdb.IPRange
+		if finalized, err = sc.FinalizeDrains(ctx); err == nil {
+			res["finalized"] = finalized
+		}
+	case CMD_USAGE:
+		var used, size uint32
+		if used, size, err = sc.Usage(ctx); err == nil {
+			res["used"] = used
+			res["size"] = size
+		}
+	case CMD_FSCK:
+		var report *dhcpdb.FsckReport
+		if report, err = sc.Fsck(ctx, getStringParam(obj, "repair", "0") != "0"); err == nil {
+			utils.Log.Printf("Consistency check performed, clean: %t, fixes applied: %d\n", report.Clean(), report.Repaired)
+			res["clean"] = report.Clean()
+			res["report"] = report
+		}
+	case CMD_HISTORY:
+		q := dhcpdb.AuditQuery{
+			IP:    getStringParam(obj, "ip", ""),
+			MAC:   getStringParam(obj, "mac", ""),
+			Limit: getIntParam(obj, "limit", 1000),
+		}
+		if q.From, err = getTimeParam(obj, "from"); err == nil {
+			if q.To, err = getTimeParam(obj, "to"); err == nil {
+				err = requireAudit(audit)
+			}
+		}
+		if err == nil {
+			var events []*dhcpdb.AuditEvent
+			if events, err = audit.Query(ctx, q); err == nil {
+				res["events"] = events
+			}
+		}
+	case CMD_WHO_HAD:
+		var at time.Time
+		if at, err = getTimeParam(obj, "at"); err == nil {
+			if at.IsZero() {
+				at = time.Now()
+			}
+			err = requireAudit(audit)
+		}
+		if err == nil {
+			var event *dhcpdb.AuditEvent
+			if event, err = audit.WhoHad(ctx, getStringParam(obj, "ip", ""), at); err == nil {
+				res["lease"] = event
+			}
+		}
+	case CMD_EXPORT:
+		err = exportLeases(ctx, sc, obj, res)
+	case CMD_IMPORT:
+		var report *dhcpdb.ImportReport
+		if report, err = importLeases(ctx, sc, obj); err == nil {
+			utils.Log.Printf("Lease file imported (dry run: %t): %d leases, %d hosts, %d conflicts\n",
+				report.DryRun, report.Leases, report.Hosts, len(report.Conflicts))
+			res["report"] = report
+		}
+	case CMD_SNAPSHOT:
+		var snap *dhcpdb.Snapshot
+		if snap, err = sc.TakeSnapshot(ctx); err == nil {
+			err = writeOutput(obj, res, func(w io.Writer) error {
+				return dhcpdb.WriteSnapshot(w, snap)
+			})
+			res["leases"] = len(snap.Leases)
+		}
+	case CMD_RESTORE:
+		var snap *dhcpdb.Snapshot
+		err = readInput(obj, func(r io.Reader) (err error) {
+			snap, err = dhcpdb.ReadSnapshot(r)
+			return err
+		})
+		if err == nil {
+			if err = sc.RestoreSnapshot(ctx, snap); err == nil {
+				utils.Log.Printf("Snapshot of %s restored, %d leases\n", snap.Created, len(snap.Leases))
+				res["leases"] = len(snap.Leases)
+				res["created"] = snap.Created
+			}
+		}
+	default:
+		err = fmt.Errorf("Error unknown command %s", cmd)
+	}
+
+	if err != nil {
+		utils.Log.Println(err)
+		res["error"] = err.Error()
+		return res
+	}
+
+	pool := sc.Pool()
+	utils.Log.Printf("Command %s executed, pool version %d\n", cmd, pool.Version)
+	res["version"] = pool.Version
+	res["ranges"] = pool.Ranges
+	res["draining"] = pool.Draining
+	return res
+}
+
+// Returns the time parameter name, in RFC 3339 format, or the zero time if not provided
+func getTimeParam(obj map[string]interface{}, name string) (time.Time, error) {
+	str := getStringParam(obj, name, "")
+	if str == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Error parsing %s parameter: %s", name, err)
+	}
+	return t, nil
+}
+
+func requireAudit(audit *dhcpdb.AuditLog) error {
+	if audit == nil {
+		return fmt.Errorf("Error lease history disabled")
+	}
+	return nil
+}
+
+// Writes the output of write to the file parameter, or returns it into the
+// data field of the result if no file is provided
+func writeOutput(obj map[string]interface{}, res map[string]interface{}, write func(w io.Writer) error) error {
+	path := getStringParam(obj, "file", "")
+	if path == "" {
+		var buf bytes.Buffer
+		if err := write(&buf); err != nil {
+			return err
+		}
+		res["data"] = buf.String()
+		return nil
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("Error creating file %s: %s", path, err)
+	}
+	defer file.Close()
+
+	if err := write(file); err != nil {
+		return fmt.Errorf("Error writing file %s: %s", path, err)
+	}
+	res["file"] = path
+	return file.Sync()
+}
+
+// Calls read with the content of the file parameter or, if not provided, of
+// the data parameter
+func readInput(obj map[string]interface{}, read func(r io.Reader) error) error {
+	path := getStringParam(obj, "file", "")
+	if path == "" {
+		return read(strings.NewReader(getStringParam(obj, "data", "")))
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Error opening file %s: %s", path, err)
+	}
+	defer file.Close()
+
+	return read(file)
+}
+
+// Writes the leases and reservations in the format parameter
+func exportLeases(ctx context.Context, sc *dhcpdb.SharedContext, obj map[string]interface{}, res map[string]interface{}) error {
+	lf, err := dhcpdb.ReadLeaseFile(ctx, sc, sc.Reservations())
+	if err != nil {
+		return err
+	}
+
+	lf.SubnetID = uint32(getIntParam(obj, "keaSubnetId", 0))
+	format := getStringParam(obj, "format", dhcpdb.LEASE_FORMAT_ISC)
+
+	return writeOutput(obj, res, func(w io.Writer) error {
+		return dhcpdb.WriteLeaseFile(format, w, lf)
+	})
+}
+
+// Imports a lease file in the format parameter
+func importLeases(ctx context.Context, sc *dhcpdb.SharedContext, obj map[string]interface{}) (*dhcpdb.ImportReport, error) {
+	var lf *dhcpdb.LeaseFile
+	err := readInput(obj, func(r io.Reader) (err error) {
+		lf, err = dhcpdb.ParseLeaseFile(getStringParam(obj, "format", dhcpdb.LEASE_FORMAT_ISC), r)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return dhcpdb.ImportLeaseFile(ctx, sc, sc.Pool(), sc.Reservations(), lf, getStringParam(obj, "dryRun", "0") != "0")
+}
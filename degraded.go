@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dhcpdb"
+	"utils"
+)
+
+const (
+	WRITE_BIND    = "bind"
+	WRITE_RENEW   = "renew"
+	WRITE_RELEASE = "release"
+)
+
+// Store write made while Redis was unreachable, replayed once it returns
+type pendingWrite struct {
+	op     string
+	ip     net.IP
+	mac    net.HardwareAddr
+	expiry time.Time // zero for releases and infinite leases
+}
+
+/*
+State of the handler while Redis is unreachable. Renewals of the bindings last
+seen by the lease cache, trusted or not, are acknowledged, new leases are only
+made from the local block, an address range claimed by this replica in Redis
+(excluded from the shared pool) if configured, and all the writes are queued
+and replayed in order when Redis is back.
+*/
+type degradedMode struct {
+	mu       sync.Mutex
+	local    *dhcpdb.MemStore // Bindings of the local block, nil if none
+	block    *dhcpdb.Pool
+	held     int32 // 1 while the claim of the local block is held
+	queue    []pendingWrite
+	maxQueue int
+}
+
+func newDegradedMode(block *dhcpdb.Pool, maxQueue int) *degradedMode {
+	dm := &degradedMode{maxQueue: maxQueue}
+	if block != nil {
+		dm.block = block
+		dm.local = dhcpdb.NewMemStore(block)
+		dm.held = 1
+	}
+	return dm
+}
+
+// Returns true if the address belongs to the local block
+func (dm *degradedMode) owns(ipAddr net.IP) bool {
+	if dm.block == nil || atomic.LoadInt32(&dm.held) == 0 {
+		return false
+	}
+	_, ok := dm.block.Index(ipAddr)
+	return ok
+}
+
+func (dm *degradedMode) enqueue(w pendingWrite) error {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	if len(dm.queue) >= dm.maxQueue {
+		return fmt.Errorf("%w, degraded mode write queue full (%d writes)", dhcpdb.ErrUnavailable, dm.maxQueue)
+	}
+	dm.queue = append(dm.queue, w)
+	return nil
+}
+
+// Returns a free address of the local block
+func (dm *degradedMode) allocate(ctx context.Context) (*net.IP, error) {
+	if dm.local == nil || atomic.LoadInt32(&dm.held) == 0 {
+		return nil, fmt.Errorf("%w, new leases suspended", dhcpdb.ErrUnavailable)
+	}
+	return dm.local.GetFirstAvailableAddress(ctx)
+}
+
+// Returns the hardware address bound to an address of the local block
+func (dm *degradedMode) binding(ctx context.Context, ipAddr net.IP) (*net.HardwareAddr, error) {
+	if !dm.owns(ipAddr) {
+		return nil, fmt.Errorf("%w, binding of %s unknown", dhcpdb.ErrUnavailable, ipAddr)
+	}
+	return dm.local.GetPortMACMapping(ctx, &ipAddr)
+}
+
+/*
+Records a binding or renewal made while Redis is unreachable. New bindings are
+only accepted on the local block.
+*/
+func (dm *degradedMode) bind(ctx context.Context, op string, ipAddr net.IP, hwAddr net.HardwareAddr, leaseTime time.Duration) error {
+	if dm.owns(ipAddr) {
+		var err error
+		if op == WRITE_RENEW {
+			err = dm.local.RenewIPMACMapping(ctx, &ipAddr, &hwAddr, leaseTime)
+		}
+		if op == WRITE_BIND || err != nil {
+			err = dm.local.AddIPMACMapping(ctx, &ipAddr, &hwAddr, leaseTime)
+		}
+		if err != nil {
+			return err
+		}
+	} else if op == WRITE_BIND {
+		return fmt.Errorf("%w, new leases suspended", dhcpdb.ErrUnavailable)
+	}
+
+	w := pendingWrite{op: op, ip: ipAddr, mac: hwAddr}
+	if leaseTime > 0 {
+		w.expiry = time.Now().Add(leaseTime)
+	}
+	return dm.enqueue(w)
+}
+
+func (dm *degradedMode) release(ctx context.Context, ipAddr net.IP, hwAddr net.HardwareAddr) error {
+	if dm.owns(ipAddr) {
+		if err := dm.local.RemoveIPMapping(ctx, &ipAddr, &hwAddr); err != nil {
+			return err
+		}
+	}
+	return dm.enqueue(pendingWrite{op: WRITE_RELEASE, ip: ipAddr, mac: hwAddr})
+}
+
+/*
+Replays the queued writes to the store, in order, stopping at the first one
+failing because Redis is still unreachable or at shutdown. Leases expired in
+the meanwhile are skipped, renewals of bindings lost in the meanwhile become
+new bindings.
+*/
+func (dm *degradedMode) replay(ctx context.Context, store dhcpdb.LeaseStore) error {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	for len(dm.queue) > 0 {
+		w := dm.queue[0]
+		ipAddr, hwAddr := w.ip, w.mac
+
+		var err error
+		switch w.op {
+		case WRITE_RELEASE:
+			err = store.RemoveIPMapping(ctx, &ipAddr, &hwAddr)
+		default:
+			leaseTime := time.Duration(0)
+			if !w.expiry.IsZero() {
+				if leaseTime = time.Until(w.expiry); leaseTime <= 0 {
+					break // expired, nothing to replay
+				}
+			}
+			if w.op == WRITE_RENEW {
+				err = store.RenewIPMACMapping(ctx, &ipAddr, &hwAddr, leaseTime)
+			}
+			if w.op == WRITE_BIND || (err != nil && !dhcpdb.IsUnavailable(err)) {
+				err = store.AddIPMACMapping(ctx, &ipAddr, &hwAddr, leaseTime)
+			}
+		}
+
+		if dhcpdb.IsUnavailable(err) || ctx.Err() != nil {
+			return err
+		} else if err != nil {
+			// conflicting with a binding made by another replica, which wins
+			utils.Log.Printf("Error replaying %s of %s - %s: %s\n", w.op, ipAddr, hwAddr, err)
+		}
+		dm.queue = dm.queue[1:]
+	}
+
+	return nil
+}
+
+/*
+Replays the queued writes every interval until the context is cancelled.
+*/
+func (dm *degradedMode) run(ctx context.Context, store dhcpdb.LeaseStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			dm.mu.Lock()
+			pending := len(dm.queue)
+			dm.mu.Unlock()
+
+			if pending == 0 {
+				continue
+			}
+			if err := dm.replay(ctx, store); err == nil {
+				utils.Log.Printf("Redis reachable again, %d queued writes replayed\n", pending)
+			}
+		}
+	}
+}
+
+/*
+Claims the first local block of the comma separated list not held by another
+replica, returning nil if all of them are. Local blocks must be excluded from
+the shared pool, so that no other replica leases their addresses, and inside
+its ranges, so that their bindings can be replayed to the store.
+*/
+func claimLocalBlock(ctx context.Context, sc *dhcpdb.SharedContext, blocks string, ttl time.Duration) (*dhcpdb.Pool, error) {
+	pool := sc.Pool()
+	for _, blockStr := range strings.Split(blocks, ",") {
+		r, err := dhcpdb.ParseIPRange(blockStr)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkLocalBlock(pool, r); err != nil {
+			return nil, err
+		}
+
+		if err := sc.ClaimLocalBlock(ctx, r, ttl); errors.Is(err, dhcpdb.ErrConflict) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		return dhcpdb.NewPool([]string{r.String()}, nil, pool.Mask)
+	}
+
+	return nil, nil
+}
+
+// Returns an error if the range is not inside one of the pool ranges or not
+// excluded from the pool
+func checkLocalBlock(pool *dhcpdb.Pool, r dhcpdb.IPRange) error {
+	within := func(ranges []dhcpdb.IPRange) bool {
+		for _, pr := range ranges {
+			if pr.Contains(r.Start) && pr.Contains(r.End) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !within(pool.Ranges) {
+		return fmt.Errorf("Error local block %s out of the pool ranges", r)
+	}
+	if !within(pool.Exclusions) {
+		return fmt.Errorf("Error local block %s not excluded from the pool", r)
+	}
+	return nil
+}
+
+// Copies the active bindings of the local block addresses from the store, made
+// by a previous holder of the block
+func (dm *degradedMode) load(ctx context.Context, store dhcpdb.LeaseStore) error {
+	if dm.local == nil {
+		return nil
+	}
+
+	return store.ForEachMapping(ctx, func(lease *dhcpdb.Lease) error {
+		if _, ok := dm.block.Index(lease.IP); !ok {
+			return nil
+		}
+		leaseTime := time.Duration(0)
+		if !lease.Expiry.IsZero() {
+			if leaseTime = time.Until(lease.Expiry); leaseTime <= 0 {
+				return nil
+			}
+		}
+		return dm.local.AddIPMACMapping(ctx, &lease.IP, &lease.HwAddr, leaseTime)
+	})
+}
+
+/*
+Renews the claim of the local block every ttl/3 until the context is
+cancelled, then gives it back. The claim is kept while Redis is unreachable;
+once taken by another replica, after an outage longer than ttl, no more new
+leases are made on the block.
+*/
+func (dm *degradedMode) hold(ctx context.Context, sc *dhcpdb.SharedContext, ttl time.Duration) {
+	if dm.block == nil {
+		return
+	}
+	r := dm.block.Ranges[0]
+
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			releaseCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := sc.ReleaseLocalBlock(releaseCtx, r); err != nil {
+				utils.Log.Println(err)
+			}
+			return
+		case <-ticker.C:
+			if err := sc.ClaimLocalBlock(ctx, r, ttl); errors.Is(err, dhcpdb.ErrConflict) {
+				utils.Log.Println(err)
+				atomic.StoreInt32(&dm.held, 0)
+				return
+			} else if err != nil {
+				utils.Log.Println(err)
+			}
+		}
+	}
+}
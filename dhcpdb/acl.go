@@ -0,0 +1,158 @@
+package dhcpdb
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	ACL_ALLOW_LIST     = "aclAllow"
+	ACL_DENY_LIST      = "aclDeny"
+	ACL_DENIED_COUNTER = "aclDenied"
+	ACL_GLOBAL_SCOPE   = "global"
+	ACL_CLASS_PREFIX   = "class:"
+)
+
+/*
+AccessControl checks the clients of a pool against the global and per-pool
+allow and deny lists stored into Redis. Entries can be exact MAC addresses
+(aa:bb:cc:dd:ee:ff), OUI prefixes (aa:bb:cc) or client classes (class:name).
+*/
+type AccessControl struct {
+	client redis.UniversalClient
+	ks     Keyspace
+	pool   string
+}
+
+func NewAccessControl(client redis.UniversalClient, ks Keyspace, pool string) *AccessControl {
+	return &AccessControl{
+		client: client,
+		ks:     ks,
+		pool:   pool,
+	}
+}
+
+func aclKey(ks Keyspace, list, scope string) string {
+	return ks.Key(list + ":" + scope)
+}
+
+/*
+Returns the normalized form of an ACL entry, or an error if the entry is
+neither a MAC address, an OUI prefix nor a client class.
+*/
+func NormalizeACLEntry(entry string) (string, error) {
+	if strings.HasPrefix(entry, ACL_CLASS_PREFIX) {
+		if len(entry) == len(ACL_CLASS_PREFIX) {
+			return "", fmt.Errorf("Error empty client class in ACL entry %s", entry)
+		}
+		return entry, nil
+	}
+
+	if hwAddr, err := net.ParseMAC(entry); err == nil {
+		return hwAddr.String(), nil
+	}
+
+	if hwAddr, err := net.ParseMAC(entry + ":00:00:00"); err == nil && len(hwAddr) == 6 {
+		return hwAddr[:3].String(), nil
+	}
+
+	return "", fmt.Errorf("Error invalid ACL entry %s", entry)
+}
+
+func AddACLEntry(ctx context.Context, client redis.UniversalClient, ks Keyspace, list, scope, entry string) error {
+	norm, err := NormalizeACLEntry(entry)
+	if err != nil {
+		return err
+	}
+
+	if err := client.SAdd(ctx, aclKey(ks, list, scope), norm).Err(); err != nil {
+		return fmt.Errorf("Error adding entry %s to %s: %s", norm, aclKey(ks, list, scope), err)
+	}
+
+	return nil
+}
+
+func RemoveACLEntry(ctx context.Context, client redis.UniversalClient, ks Keyspace, list, scope, entry string) error {
+	norm, err := NormalizeACLEntry(entry)
+	if err != nil {
+		return err
+	}
+
+	if err := client.SRem(ctx, aclKey(ks, list, scope), norm).Err(); err != nil {
+		return fmt.Errorf("Error removing entry %s from %s: %s", norm, aclKey(ks, list, scope), err)
+	}
+
+	return nil
+}
+
+/*
+Returns true if the client identified by the hardware address and the
+(optional) class is allowed to obtain a lease from the pool. A match on a deny
+list always wins; if any allow list is not empty the client must match it.
+Lists are read at every call so updates are seen by all replicas immediately.
+*/
+func (ac *AccessControl) IsAllowed(ctx context.Context, hwAddr net.HardwareAddr, class string) (bool, error) {
+	candidates := []string{hwAddr.String()}
+	if len(hwAddr) >= 3 {
+		candidates = append(candidates, hwAddr[:3].String())
+	}
+	if class != "" {
+		candidates = append(candidates, ACL_CLASS_PREFIX+class)
+	}
+
+	scopes := []string{ACL_GLOBAL_SCOPE, ac.pool}
+	pipe := ac.client.Pipeline()
+
+	var denyCmds, allowCmds []*redis.BoolCmd
+	var allowSizes []*redis.IntCmd
+	for _, scope := range scopes {
+		for _, c := range candidates {
+			denyCmds = append(denyCmds, pipe.SIsMember(ctx, aclKey(ac.ks, ACL_DENY_LIST, scope), c))
+			allowCmds = append(allowCmds, pipe.SIsMember(ctx, aclKey(ac.ks, ACL_ALLOW_LIST, scope), c))
+		}
+		allowSizes = append(allowSizes, pipe.SCard(ctx, aclKey(ac.ks, ACL_ALLOW_LIST, scope)))
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, unavailable(fmt.Errorf("Error reading access lists for pool %s: %w", ac.pool, err))
+	}
+
+	for _, cmd := range denyCmds {
+		if cmd.Val() {
+			return false, nil
+		}
+	}
+
+	restricted := false
+	for _, cmd := range allowSizes {
+		if cmd.Val() > 0 {
+			restricted = true
+		}
+	}
+	if !restricted {
+		return true, nil
+	}
+
+	for _, cmd := range allowCmds {
+		if cmd.Val() {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+/*
+Increments the counter of denied requests for the pool.
+*/
+func (ac *AccessControl) CountDenied(ctx context.Context) error {
+	if err := ac.client.HIncrBy(ctx, ac.ks.Key(ACL_DENIED_COUNTER), ac.pool, 1).Err(); err != nil {
+		return fmt.Errorf("Error incrementing %s counter for pool %s: %s", ACL_DENIED_COUNTER, ac.pool, err)
+	}
+
+	return nil
+}
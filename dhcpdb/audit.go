@@ -0,0 +1,262 @@
+package dhcpdb
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	AUDIT_STREAM         = "leaseHistory"
+	AUDIT_BIND           = "bind"
+	AUDIT_RENEW          = "renew"
+	AUDIT_RELEASE        = "release"
+	AUDIT_DECLINE        = "decline"
+	AUDIT_EXPIRE         = "expire"
+	DEFAULT_AUDIT_MAXLEN = 1000000
+	AUDIT_QUERY_BATCH    = 1000
+)
+
+/*
+AuditEvent is an entry of the lease history. LeaseTime is zero for the events
+ending a lease, ClientID is the hex encoded client identifier (option 61) and
+Relay the relay agent identifiers (option 82) of the request, if any.
+*/
+type AuditEvent struct {
+	ID        string        `json:"id,omitempty"`
+	Type      string        `json:"type"`
+	Time      time.Time     `json:"time"`
+	IP        string        `json:"ip"`
+	MAC       string        `json:"mac"`
+	LeaseTime time.Duration `json:"leaseTime,omitempty"`
+	ClientID  string        `json:"clientId,omitempty"`
+	Hostname  string        `json:"hostname,omitempty"`
+	Relay     []string      `json:"relay,omitempty"`
+	GIAddr    string        `json:"giaddr,omitempty"`
+}
+
+/*
+AuditQuery selects the events of the lease history between From and To
+(zero values meaning unbounded), optionally restricted to an address and/or a
+hardware address. At most Limit events are returned, all of them if zero.
+*/
+type AuditQuery struct {
+	From  time.Time
+	To    time.Time
+	IP    string
+	MAC   string
+	Limit int
+}
+
+/*
+AuditLog records the lease events into an append-only Redis stream shared by
+all the replicas. The stream is trimmed at every write to about MaxLen entries
+and, if Retention is not zero, to the entries younger than Retention.
+*/
+type AuditLog struct {
+	client    redis.UniversalClient
+	ks        Keyspace
+	MaxLen    int64
+	Retention time.Duration
+}
+
+func NewAuditLog(client redis.UniversalClient, ks Keyspace, maxLen int64, retention time.Duration) *AuditLog {
+	if maxLen <= 0 {
+		maxLen = DEFAULT_AUDIT_MAXLEN
+	}
+
+	return &AuditLog{
+		client:    client,
+		ks:        ks,
+		MaxLen:    maxLen,
+		Retention: retention,
+	}
+}
+
+func (al *AuditLog) Record(ctx context.Context, event *AuditEvent) error {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	values := map[string]interface{}{
+		"type": event.Type,
+		"time": event.Time.UnixNano(),
+		"ip":   event.IP,
+		"mac":  event.MAC,
+	}
+	if event.LeaseTime > 0 {
+		values["lease"] = int64(event.LeaseTime / time.Second)
+	}
+	if event.ClientID != "" {
+		values["clientId"] = event.ClientID
+	}
+	if event.Hostname != "" {
+		values["hostname"] = event.Hostname
+	}
+	if len(event.Relay) > 0 {
+		values["relay"] = strings.Join(event.Relay, ",")
+	}
+	if event.GIAddr != "" {
+		values["giaddr"] = event.GIAddr
+	}
+
+	key := al.ks.Key(AUDIT_STREAM)
+	pipe := al.client.Pipeline()
+	id := pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream:       key,
+		MaxLenApprox: al.MaxLen,
+		Values:       values,
+	})
+	if al.Retention > 0 {
+		minID := strconv.FormatInt(time.Now().Add(-al.Retention).UnixNano()/int64(time.Millisecond), 10)
+		pipe.Do(ctx, "XTRIM", key, "MINID", "~", minID)
+	}
+
+	// trimming by age requires Redis 6.2, only the failure of the write matters
+	if _, err := pipe.Exec(ctx); err != nil && id.Err() != nil {
+		return fmt.Errorf("Error recording %s event of %s: %s", event.Type, event.IP, err)
+	}
+	event.ID = id.Val()
+
+	return nil
+}
+
+// returns the stream ID of the first entry at or after t
+func streamID(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+}
+
+// returns the stream ID following id
+func nextStreamID(id string) string {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) == 2 {
+		if seq, err := strconv.ParseUint(parts[1], 10, 64); err == nil && seq < ^uint64(0) {
+			return parts[0] + "-" + strconv.FormatUint(seq+1, 10)
+		}
+	}
+	ms, _ := strconv.ParseUint(parts[0], 10, 64)
+	return strconv.FormatUint(ms+1, 10) + "-0"
+}
+
+// returns the stream ID preceding id
+func prevStreamID(id string) string {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) == 2 {
+		if seq, err := strconv.ParseUint(parts[1], 10, 64); err == nil && seq > 0 {
+			return parts[0] + "-" + strconv.FormatUint(seq-1, 10)
+		}
+	}
+	ms, _ := strconv.ParseUint(parts[0], 10, 64)
+	if ms == 0 {
+		return "0-0"
+	}
+	return strconv.FormatUint(ms-1, 10) + "-" + strconv.FormatUint(^uint64(0), 10)
+}
+
+func decodeAuditEvent(msg redis.XMessage) *AuditEvent {
+	str := func(name string) string {
+		s, _ := msg.Values[name].(string)
+		return s
+	}
+
+	event := &AuditEvent{
+		ID:       msg.ID,
+		Type:     str("type"),
+		IP:       str("ip"),
+		MAC:      str("mac"),
+		ClientID: str("clientId"),
+		Hostname: str("hostname"),
+		GIAddr:   str("giaddr"),
+	}
+	if nsec, err := strconv.ParseInt(str("time"), 10, 64); err == nil {
+		event.Time = time.Unix(0, nsec)
+	}
+	if secs, err := strconv.ParseInt(str("lease"), 10, 64); err == nil {
+		event.LeaseTime = time.Duration(secs) * time.Second
+	}
+	if relay := str("relay"); relay != "" {
+		event.Relay = strings.Split(relay, ",")
+	}
+
+	return event
+}
+
+func (q *AuditQuery) matches(event *AuditEvent) bool {
+	return (q.IP == "" || q.IP == event.IP) && (q.MAC == "" || strings.EqualFold(q.MAC, event.MAC))
+}
+
+/*
+Returns the events matching the query, oldest first.
+*/
+func (al *AuditLog) Query(ctx context.Context, q AuditQuery) ([]*AuditEvent, error) {
+	start, stop := "-", "+"
+	if !q.From.IsZero() {
+		start = streamID(q.From)
+	}
+	if !q.To.IsZero() {
+		stop = streamID(q.To)
+	}
+
+	var res []*AuditEvent
+	for {
+		msgs, err := al.client.XRangeN(ctx, al.ks.Key(AUDIT_STREAM), start, stop, AUDIT_QUERY_BATCH).Result()
+		if err != nil {
+			return nil, fmt.Errorf("Error reading lease history: %s", err)
+		}
+
+		for _, msg := range msgs {
+			if event := decodeAuditEvent(msg); q.matches(event) {
+				res = append(res, event)
+				if q.Limit > 0 && len(res) >= q.Limit {
+					return res, nil
+				}
+			}
+		}
+
+		if len(msgs) < AUDIT_QUERY_BATCH {
+			return res, nil
+		}
+		start = nextStreamID(msgs[len(msgs)-1].ID)
+	}
+}
+
+/*
+Returns the event granting the lease the address was bound with at the given
+time, nil if the address was free. The history is read backwards from at, up
+to the first event of the address.
+*/
+func (al *AuditLog) WhoHad(ctx context.Context, ip string, at time.Time) (*AuditEvent, error) {
+	end := streamID(at)
+	for {
+		msgs, err := al.client.XRevRangeN(ctx, al.ks.Key(AUDIT_STREAM), end, "-", AUDIT_QUERY_BATCH).Result()
+		if err != nil {
+			return nil, fmt.Errorf("Error reading lease history: %s", err)
+		}
+
+		for _, msg := range msgs {
+			event := decodeAuditEvent(msg)
+			if event.IP != ip || event.Time.After(at) {
+				continue
+			}
+
+			switch event.Type {
+			case AUDIT_BIND, AUDIT_RENEW:
+				if event.LeaseTime == 0 || event.Time.Add(event.LeaseTime).After(at) {
+					return event, nil
+				}
+				return nil, nil
+			default:
+				return nil, nil
+			}
+		}
+
+		if len(msgs) < AUDIT_QUERY_BATCH {
+			return nil, nil
+		}
+		end = prevStreamID(msgs[len(msgs)-1].ID)
+	}
+}
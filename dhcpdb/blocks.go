@@ -0,0 +1,135 @@
+package dhcpdb
+
+import (
+	"context"
+	"fmt"
+	"math/bits"
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	RANGE_BLOCK_BITS  = 8192
+	FREE_BLOCKS_SET   = "freeBlocks"
+	POOL_USED_COUNTER = "poolUsed"
+	RANGE_WATERMARK   = "rangeWatermark"
+)
+
+/*
+The leasing range is split into blocks of RANGE_BLOCK_BITS bits, each one
+stored into its own key (leasingRange:<n>) and created only when one of its
+addresses is used, so memory grows with the leases instead of the pool size.
+Blocks with free addresses are indexed by a sorted set, blocks at or beyond
+the watermark have never been allocated from, and a counter keeps the number
+of bits set (leases, reserved addresses and padding of the last block), so
+neither allocation nor exhaustion detection needs to scan the range.
+*/
+
+// returns the number of blocks needed by a leasing range of the given size
+func blockCount(size uint32) uint32 {
+	return uint32((uint64(size) + RANGE_BLOCK_BITS - 1) / RANGE_BLOCK_BITS)
+}
+
+// returns the key of a block of the leasing range
+func blockKey(ks Keyspace, block uint32) string {
+	return ks.Key(LEASING_RANGE_BITSET + ":" + strconv.FormatUint(uint64(block), 10))
+}
+
+// returns the keys shared by all the scripts updating the leasing range
+func rangeKeys(ks Keyspace) []string {
+	return []string{ks.Key(LEASING_RANGE_BITSET), ks.Key(FREE_BLOCKS_SET), ks.Key(POOL_USED_COUNTER),
+		ks.Key(RANGE_WATERMARK)}
+}
+
+/*
+Returns the number of addresses of the pool in use, leased or reserved, and
+the size of the pool. Values are read from the counter kept by the scripts,
+without scanning the leasing range.
+*/
+func (sc *SharedContext) Usage(ctx context.Context) (uint32, uint32, error) {
+	used, err := sc.client.Get(ctx, sc.ks.Key(POOL_USED_COUNTER)).Int64()
+	if err != nil && err != redis.Nil {
+		return 0, 0, fmt.Errorf("Error reading %s counter: %s", POOL_USED_COUNTER, err)
+	}
+
+	size := sc.Pool().Size()
+	used -= int64(blockCount(size))*RANGE_BLOCK_BITS - int64(size)
+	if used < 0 {
+		used = 0
+	}
+
+	return uint32(used), size, nil
+}
+
+// deletes the blocks of the leasing range and their summaries
+func deleteRangeBlocks(ctx context.Context, client redis.UniversalClient, ks Keyspace) error {
+	err := scanKeys(ctx, client, ks.Key(LEASING_RANGE_BITSET+":*"), func(keys []string) error {
+		for _, key := range keys {
+			if err := client.Del(ctx, key).Err(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error deleting leasing range blocks: %s", err)
+	}
+
+	if err := client.Del(ctx, rangeKeys(ks)[1:]...).Err(); err != nil {
+		return fmt.Errorf("Error deleting leasing range summaries: %s", err)
+	}
+
+	return nil
+}
+
+/*
+Splits a leasing range stored as a single bitset, the layout used before the
+range was split into blocks, into the blocks of the keyspace and deletes it.
+Positions are kept; the used bits counter, the free blocks set and the
+watermark are rebuilt. Padding bits are left free, allocation never goes
+beyond the pool size anyway.
+*/
+func convertLegacyRange(ctx context.Context, client redis.UniversalClient, from string, ks Keyspace) error {
+	bitset, err := client.Get(ctx, from).Bytes()
+	if err == redis.Nil {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Error reading legacy leasing range %s: %s", from, err)
+	}
+
+	// the keys may belong to different Cluster slots, so no transaction
+	_, err = client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		blockBytes := RANGE_BLOCK_BITS / 8
+		used := 0
+		n := 0
+		for ; n*blockBytes < len(bitset); n++ {
+			block := bitset[n*blockBytes:]
+			if len(block) > blockBytes {
+				block = block[:blockBytes]
+			}
+
+			count := 0
+			for _, b := range block {
+				count += bits.OnesCount8(b)
+			}
+			if count > 0 {
+				pipe.Set(ctx, blockKey(ks, uint32(n)), block, 0)
+			}
+			if count < RANGE_BLOCK_BITS {
+				pipe.ZAdd(ctx, ks.Key(FREE_BLOCKS_SET), &redis.Z{Score: float64(n), Member: n})
+			}
+			used += count
+		}
+
+		pipe.Set(ctx, ks.Key(POOL_USED_COUNTER), used, 0)
+		pipe.Set(ctx, ks.Key(RANGE_WATERMARK), n, 0)
+		pipe.Del(ctx, from)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error converting legacy leasing range %s: %s", from, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package dhcpdb
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRangeBlocks(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestClient(t)
+	ks := NewKeyspace("test")
+
+	// 8202 addresses, the first block excluded but for its last five
+	pool, err := NewPool([]string{"10.0.0.1-10.0.32.10"}, []string{"10.0.0.1-10.0.31.251"}, net.IPv4Mask(255, 255, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := InitPool(ctx, client, ks, pool, false); err != nil {
+		t.Fatal(err)
+	}
+	sc := NewSharedContext(client, ks, pool)
+	size := int(pool.Size())
+	free := 15
+
+	seen := make(map[string]bool, free)
+	for i := 0; i < free; i++ {
+		ipAddr := allocate(t, sc).String()
+		if seen[ipAddr] {
+			t.Fatalf("%s offered twice", ipAddr)
+		}
+		seen[ipAddr] = true
+	}
+	if _, err := sc.GetFirstAvailableAddress(ctx); err != ErrPoolExhausted {
+		t.Fatalf("allocation of an exhausted pool: %v, want %v", err, ErrPoolExhausted)
+	}
+	if used, _, err := sc.Usage(ctx); err != nil || int(used) != size {
+		t.Errorf("Usage() = %d, %v, want %d", used, err, size)
+	}
+
+	// freed addresses are allocated again lowest block first
+	for _, ip := range []string{"10.0.32.5", "10.0.31.253"} {
+		ipAddr := net.ParseIP(ip).To4()
+		if err := sc.AddIPMACMapping(ctx, &ipAddr, &testMAC, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		if err := sc.RemoveIPMapping(ctx, &ipAddr, &testMAC); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"10.0.31.253", "10.0.32.5"} {
+		if ipAddr := allocate(t, sc); ipAddr.String() != want {
+			t.Errorf("offered %s, want %s", ipAddr, want)
+		}
+	}
+
+	report, err := sc.Fsck(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.UsedCounter != report.UsedBits {
+		t.Errorf("used counter %d, %d bits set", report.UsedCounter, report.UsedBits)
+	}
+}
@@ -0,0 +1,86 @@
+package dhcpdb
+
+import (
+	"context"
+	"net"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/krolaw/dhcp4"
+)
+
+const (
+	BOOTP_RANGE_BITSET  = "bootpRange"
+	BOOTP_BINDINGS_HASH = "bootpBindings"
+)
+
+/*
+BootpPool is a dynamic pool for plain BOOTP clients. Since BOOTP has no lease
+concept, addresses are bound forever to the client hardware address.
+*/
+type BootpPool struct {
+	client             redis.UniversalClient
+	ks                 Keyspace
+	rangeStartIp       *net.IP
+	size               uint32
+	maxTxRetryAttempts uint8
+}
+
+func NewBootpPool(client redis.UniversalClient, ks Keyspace, startIP *net.IP, size uint32, maxTxRetryAttempts uint8) *BootpPool {
+	return &BootpPool{
+		client:             client,
+		ks:                 ks,
+		rangeStartIp:       startIP,
+		size:               size,
+		maxTxRetryAttempts: maxTxRetryAttempts,
+	}
+}
+
+/*
+Returns the address bound to the hardware address, binding the first free
+address of the pool if the client has none.
+*/
+func (bp *BootpPool) Assign(ctx context.Context, hwAddr net.HardwareAddr) (*net.IP, error) {
+	var addr net.IP
+	rangeKey := bp.ks.Key(BOOTP_RANGE_BITSET)
+	bindingsKey := bp.ks.Key(BOOTP_BINDINGS_HASH)
+
+	for i := uint8(0); i < bp.maxTxRetryAttempts; i++ {
+		err := bp.client.Watch(ctx, func(tx *redis.Tx) error {
+			res, err := tx.HGet(ctx, bindingsKey, hwAddr.String()).Result()
+			if err == nil {
+				addr = net.ParseIP(res)
+				return nil
+			} else if err != redis.Nil {
+				return err
+			}
+
+			pos, err := tx.BitPos(ctx, rangeKey, 0).Result()
+			if err != nil && err != redis.Nil {
+				return err
+			}
+
+			if pos < 0 || pos >= int64(bp.size) {
+				return newKindError(ErrPoolExhausted, "Error no more BOOTP addresses available")
+			}
+
+			addr = dhcp4.IPAdd(*bp.rangeStartIp, int(pos))
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.SetBit(ctx, rangeKey, pos, 1)
+				pipe.HSet(ctx, bindingsKey, hwAddr.String(), addr.String())
+				return nil
+			})
+			return err
+		}, bindingsKey, rangeKey)
+
+		if err == nil {
+			return &addr, nil
+		} else if err == redis.TxFailedErr {
+			continue
+		} else {
+			return nil, unavailable(err)
+		}
+	}
+
+	return nil, newKindError(ErrContention, "Error max retry transaction attempts exceeded (%d)", bp.maxTxRetryAttempts)
+}
@@ -0,0 +1,376 @@
+package dhcpdb
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	ADDRESS_CLAIMS_SET   = "addressClaims"
+	ADDRESS_CLAIM_PREFIX = "addressClaim"
+	DEFAULT_CLAIM_SIZE   = 64
+	DEFAULT_CLAIM_TTL    = 30 * time.Second
+	DEFAULT_CLAIM_IDLE   = 5 * time.Minute
+)
+
+/*
+Claims a set of addresses for a replica. KEYS[5] claims sorted set (replica
+identifiers scored by heartbeat deadline), KEYS[6] claimed positions set of the
+replica. ARGV[1] number of blocks of the leasing range, ARGV[2] size of the
+leasing range, ARGV[3] number of addresses to claim, ARGV[4] replica
+identifier, ARGV[5] heartbeat deadline in milliseconds. The bits of the
+claimed addresses are set, so no other replica allocates them. Returns the
+claimed positions, fewer than requested if the range is exhausted.
+*/
+var claimScript = redis.NewScript(poolVersionCheck + rangeBlockFunctions + rangeAllocFunction + `
+local res = {}
+for i = 1, tonumber(ARGV[3]) do
+	local pos = allocPos(tonumber(ARGV[1]), tonumber(ARGV[2]))
+	if pos == -1 then
+		break
+	end
+	redis.call('SADD', KEYS[6], pos)
+	res[#res + 1] = pos
+end
+if #res > 0 then
+	redis.call('ZADD', KEYS[5], ARGV[5], ARGV[4])
+end
+return res
+`)
+
+/*
+Gives back claimed addresses. KEYS[5] claims sorted set, KEYS[6] claimed
+positions set of the replica, KEYS[7] address owners hash, KEYS[8] offers
+sorted set. ARGV[1] replica identifier, ARGV[2] time in milliseconds the claim
+must have expired by, empty to give back a claim of the caller, ARGV[3] offer
+deadline in milliseconds, ARGV[4..] position, address and keep flag of each
+address. Addresses bound in the meanwhile keep their bit; the others get it
+cleared with keep flag 0, kept with 1 (excluded or draining address) or kept
+until the offer deadline with 2 (handed out to a client). The claim is dropped
+once no position is left. Returns the number of addresses freed, -1 if the
+claim has been renewed in the meanwhile.
+*/
+var unclaimScript = redis.NewScript(poolVersionCheck + rangeBlockFunctions + `
+if ARGV[2] ~= '' then
+	local deadline = redis.call('ZSCORE', KEYS[5], ARGV[1])
+	if deadline and tonumber(deadline) > tonumber(ARGV[2]) then
+		return -1
+	end
+end
+local freed = 0
+for i = 4, #ARGV - 1, 3 do
+	if redis.call('SREM', KEYS[6], ARGV[i]) == 1 and redis.call('HEXISTS', KEYS[7], ARGV[i + 1]) == 0 then
+		if ARGV[i + 2] == '2' then
+			redis.call('ZADD', KEYS[8], ARGV[3], ARGV[i])
+		elseif ARGV[i + 2] ~= '1' then
+			setPos(ARGV[i], 0)
+			freed = freed + 1
+		end
+	end
+end
+if redis.call('SCARD', KEYS[6]) == 0 then
+	redis.call('ZREM', KEYS[5], ARGV[1])
+end
+return freed
+`)
+
+// returns the key of the claimed positions set of a replica
+func claimKey(ks Keyspace, replicaID string) string {
+	return ks.Key(ADDRESS_CLAIM_PREFIX + ":" + replicaID)
+}
+
+/*
+Gives back the claimed positions of a replica. If expiredBy is not zero the
+claim is only reclaimed if its heartbeat deadline is not after it, handed are
+the positions handed out to clients, which become offers expiring after
+OFFER_TTL unless bound in the meanwhile.
+*/
+func (sc *SharedContext) unclaim(ctx context.Context, replicaID string, expiredBy time.Time, positions []uint32, handed bool) (int, error) {
+	keys := append(rangeKeys(sc.ks), sc.ks.Key(ADDRESS_CLAIMS_SET), claimKey(sc.ks, replicaID),
+		sc.ks.Key(IP_OWNERS_HASH), sc.ks.Key(ADDRESS_OFFERS_SET), sc.ks.Key(POOL_VERSION))
+	offerDeadline := time.Now().Add(OFFER_TTL).UnixNano() / int64(time.Millisecond)
+
+	var freed int
+	err := sc.withFreshPool(ctx, func() (err error) {
+		pool := sc.Pool()
+		args := []interface{}{replicaID, "", offerDeadline}
+		if !expiredBy.IsZero() {
+			args[1] = expiredBy.UnixNano() / int64(time.Millisecond)
+		}
+		for _, pos := range positions {
+			ip := pool.IPAt(pos)
+			keep := "0"
+			if ip == nil || !pool.Leasable(ip) {
+				keep = "1"
+			} else if handed {
+				keep = "2"
+			}
+			args = append(args, pos, ip.String(), keep)
+		}
+		args = append(args, pool.Version)
+
+		freed, err = unclaimScript.Run(ctx, sc.client, keys, args...).Int()
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Error giving back addresses claimed by %s: %s", replicaID, err)
+	}
+
+	return freed, nil
+}
+
+// returns the positions claimed by a replica and not handed out yet
+func (sc *SharedContext) claimedPositions(ctx context.Context, replicaID string) ([]uint32, error) {
+	members, err := sc.client.SMembers(ctx, claimKey(sc.ks, replicaID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading addresses claimed by %s: %s", replicaID, err)
+	}
+
+	positions := make([]uint32, 0, len(members))
+	for _, member := range members {
+		if pos, err := strconv.ParseUint(member, 10, 32); err == nil {
+			positions = append(positions, uint32(pos))
+		}
+	}
+	return positions, nil
+}
+
+/*
+Frees the addresses claimed by the replicas that stopped renewing their
+claims, crashed or partitioned away, except the ones bound in the meanwhile.
+Returns the number of addresses freed.
+*/
+func (sc *SharedContext) ReclaimBlocks(ctx context.Context) (int, error) {
+	now := time.Now()
+
+	expired, err := sc.client.ZRangeByScore(ctx, sc.ks.Key(ADDRESS_CLAIMS_SET), &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now.UnixNano()/int64(time.Millisecond), 10),
+	}).Result()
+	if err != nil {
+		return 0, fmt.Errorf("Error reading %s: %s", ADDRESS_CLAIMS_SET, err)
+	}
+
+	total := 0
+	for _, replicaID := range expired {
+		positions, err := sc.claimedPositions(ctx, replicaID)
+		if err != nil {
+			return total, err
+		}
+
+		freed, err := sc.unclaim(ctx, replicaID, now, positions, false)
+		if err != nil {
+			return total, err
+		}
+		if freed > 0 {
+			total += freed
+		}
+	}
+
+	return total, nil
+}
+
+/*
+BlockStore is a SharedContext allocating new addresses from blocks claimed by
+the replica, so that most allocations are served locally instead of all the
+replicas contending on the shared leasing range. Claims are renewed by Run,
+unused addresses are given back after idle time and on shutdown, and claims not
+renewed in time are reclaimed by the other replicas (see ReclaimBlocks).
+Bindings, renewals and releases still go to the shared context.
+*/
+type BlockStore struct {
+	*SharedContext
+	size    int
+	ttl     time.Duration
+	idle    time.Duration
+	logger  *log.Logger
+	mu      sync.Mutex
+	free    []uint32 // claimed, not handed out yet
+	handed  []uint32 // handed out since the last heartbeat
+	used    time.Time
+	version int64 // pool version at the time of the claim
+}
+
+func NewBlockStore(sc *SharedContext, size int, ttl, idle time.Duration, logger *log.Logger) *BlockStore {
+	if size <= 0 {
+		size = DEFAULT_CLAIM_SIZE
+	}
+	if ttl <= 0 {
+		ttl = DEFAULT_CLAIM_TTL
+	}
+	if idle <= 0 {
+		idle = DEFAULT_CLAIM_IDLE
+	}
+
+	return &BlockStore{
+		SharedContext: sc,
+		size:          size,
+		ttl:           ttl,
+		idle:          idle,
+		logger:        logger,
+	}
+}
+
+// claims a new block of addresses, called with the lock held
+func (bs *BlockStore) claim(ctx context.Context) error {
+	keys := append(rangeKeys(bs.ks), bs.ks.Key(ADDRESS_CLAIMS_SET), claimKey(bs.ks, bs.replicaID),
+		bs.ks.Key(POOL_VERSION))
+	deadline := time.Now().Add(bs.ttl).UnixNano() / int64(time.Millisecond)
+
+	var res interface{}
+	var pool *Pool
+	err := bs.withFreshPool(ctx, func() (err error) {
+		pool = bs.Pool()
+		res, err = claimScript.Run(ctx, bs.client, keys, blockCount(pool.Size()), pool.Size(),
+			bs.size, bs.replicaID, deadline, pool.Version).Result()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	bs.version = pool.Version
+
+	positions, _ := res.([]interface{})
+	for _, pos := range positions {
+		if pos, ok := pos.(int64); ok {
+			bs.free = append(bs.free, uint32(pos))
+		}
+	}
+	return nil
+}
+
+/*
+Gives back the addresses not handed out yet if the pool changed since they
+were claimed. Positions still claimed get their bit cleared, the others have
+been reset already along with the claim, by a re-initialization of the pool.
+Called with the lock held.
+*/
+func (bs *BlockStore) checkPoolVersion(ctx context.Context) error {
+	version := bs.Pool().Version
+	if version == bs.version {
+		return nil
+	}
+
+	if len(bs.free) > 0 {
+		if _, err := bs.unclaim(ctx, bs.replicaID, time.Time{}, bs.free, false); err != nil {
+			return err
+		}
+		bs.free = nil
+	}
+	bs.version = version
+	return nil
+}
+
+func (bs *BlockStore) GetFirstAvailableAddress(ctx context.Context) (*net.IP, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if err := bs.checkPoolVersion(ctx); err != nil {
+		return nil, unavailable(err)
+	}
+
+	bs.used = time.Now()
+	for {
+		if len(bs.free) == 0 {
+			if err := bs.claim(ctx); err != nil {
+				return nil, unavailable(err)
+			}
+			if len(bs.free) == 0 {
+				return nil, ErrPoolExhausted
+			}
+		}
+
+		pos := bs.free[0]
+		bs.free = bs.free[1:]
+		bs.handed = append(bs.handed, pos)
+
+		// the pool may have changed since the claim, addresses no longer
+		// leasable stay handed out and are given back with their bit set
+		pool := bs.Pool()
+		if addr := pool.IPAt(pos); addr != nil && pool.Leasable(addr) {
+			return &addr, nil
+		}
+	}
+}
+
+/*
+Renews the claim of the replica and settles the addresses handed out since the
+last call, turning the ones not bound yet into offers. If the claim has been
+reclaimed meanwhile, because the replica could not renew it in time or the
+pool has been initialized again, the local addresses are dropped: other
+replicas may be allocating them already. Addresses unused for the idle time
+or claimed before a change of the pool are given back.
+*/
+func (bs *BlockStore) heartbeat(ctx context.Context) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if len(bs.handed) > 0 {
+		if _, err := bs.unclaim(ctx, bs.replicaID, time.Time{}, bs.handed, true); err != nil {
+			return err
+		}
+		bs.handed = nil
+	}
+
+	if err := bs.checkPoolVersion(ctx); err != nil {
+		return err
+	}
+
+	if len(bs.free) == 0 {
+		return nil
+	}
+
+	if time.Since(bs.used) >= bs.idle {
+		if _, err := bs.unclaim(ctx, bs.replicaID, time.Time{}, bs.free, false); err != nil {
+			return err
+		}
+		bs.free = nil
+		return nil
+	}
+
+	deadline := float64(time.Now().Add(bs.ttl).UnixNano() / int64(time.Millisecond))
+	renewed, err := bs.client.ZAddXXCh(ctx, bs.ks.Key(ADDRESS_CLAIMS_SET), &redis.Z{Score: deadline, Member: bs.replicaID}).Result()
+	if err != nil {
+		return fmt.Errorf("Error renewing addresses claimed by %s: %s", bs.replicaID, err)
+	}
+	if renewed == 0 {
+		bs.free = nil
+		return fmt.Errorf("Error addresses claimed by %s reclaimed by another replica", bs.replicaID)
+	}
+
+	return nil
+}
+
+/*
+Renews the claim of the replica until the context is cancelled, then gives
+back the addresses not handed out, within the claim time to live.
+*/
+func (bs *BlockStore) Run(ctx context.Context) error {
+	ticker := time.NewTicker(bs.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			bs.mu.Lock()
+			bs.used = time.Time{}
+			bs.mu.Unlock()
+
+			// the context is done already, giving back gets a time bound of its own
+			giveBackCtx, cancel := context.WithTimeout(context.Background(), bs.ttl)
+			defer cancel()
+			return bs.heartbeat(giveBackCtx)
+		case <-ticker.C:
+			if err := bs.heartbeat(ctx); err != nil {
+				bs.logger.Println(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package dhcpdb
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBlockStoreClaims(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestClient(t)
+	logger := log.New(ioutil.Discard, "", 0)
+
+	// a stops renewing its claim, b keeps it for long
+	a := NewBlockStore(newTestContext(t, client, "10.0.0.10-10.0.0.19"), 3, 50*time.Millisecond, time.Hour, logger)
+	b := NewBlockStore(newTestContext(t, client, "10.0.0.10-10.0.0.19"), 3, time.Hour, time.Hour, logger)
+
+	var offered []string
+	for _, bs := range []*BlockStore{a, a, b} {
+		offered = append(offered, allocate(t, bs).String())
+	}
+	if want := []string{"10.0.0.10", "10.0.0.11", "10.0.0.13"}; !equalStrings(offered, want) {
+		t.Fatalf("offered %v, want %v", offered, want)
+	}
+
+	bound, hwAddr := net.ParseIP(offered[0]).To4(), testMAC
+	if err := a.AddIPMACMapping(ctx, &bound, &hwAddr, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// the unbound addresses of the expired claim are freed, the bound one kept
+	time.Sleep(100 * time.Millisecond)
+	if freed, err := a.ReclaimBlocks(ctx); err != nil || freed != 2 {
+		t.Fatalf("ReclaimBlocks() = %d, %v, want 2", freed, err)
+	}
+	if got := leasedTo(t, a, bound.String()); got.String() != hwAddr.String() {
+		t.Errorf("%s leased to %s after the reclaim, want %s", bound, got, hwAddr)
+	}
+	if used, _, err := a.Usage(ctx); err != nil || used != 4 {
+		t.Errorf("Usage() = %d, %v after the reclaim, want 4", used, err)
+	}
+
+	// on shutdown the address handed out becomes an offer, the others are given back
+	stopped, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := b.Run(stopped); err != nil {
+		t.Fatalf("Run() of a stopped replica: %s", err)
+	}
+	if _, err := client.ZScore(ctx, b.ks.Key(ADDRESS_OFFERS_SET), "3").Result(); err != nil {
+		t.Errorf("10.0.0.13 not offered after the shutdown: %v", err)
+	}
+	if n, err := client.ZCard(ctx, b.ks.Key(ADDRESS_CLAIMS_SET)).Result(); err != nil || n != 0 {
+		t.Errorf("%d claims left after the shutdown, want none", n)
+	}
+	if used, _, err := b.Usage(ctx); err != nil || used != 2 {
+		t.Errorf("Usage() = %d, %v after the shutdown, want 2", used, err)
+	}
+
+	report, err := b.Fsck(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Clean() {
+		t.Errorf("Fsck() found %+v, want clean", report)
+	}
+}
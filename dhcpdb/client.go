@@ -0,0 +1,139 @@
+package dhcpdb
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+)
+
+/*
+Options of the Redis deployment used by dhcpdb. MasterName selects a Sentinel
+managed deployment (Addrs are then the Sentinel addresses), Cluster a Redis
+Cluster (Addrs are seed nodes). In Cluster mode the keys must be used through
+a prefixed Keyspace, so that the keys of a pool share the same slot.
+*/
+type RedisOptions struct {
+	Addrs            []string
+	Username         string
+	Password         string
+	DB               int
+	TLS              bool
+	CACert           string // PEM encoded CA certificates, system pool if empty
+	TLSServerName    string
+	MasterName       string
+	SentinelPassword string
+	Cluster          bool
+}
+
+func NewRedisClient(opts *RedisOptions) (redis.UniversalClient, error) {
+	if len(opts.Addrs) == 0 {
+		return nil, fmt.Errorf("Error no Redis address provided")
+	}
+
+	uOpts := &redis.UniversalOptions{
+		Addrs:            opts.Addrs,
+		DB:               opts.DB,
+		Username:         opts.Username,
+		Password:         opts.Password,
+		SentinelPassword: opts.SentinelPassword,
+		MasterName:       opts.MasterName,
+	}
+
+	if opts.TLS {
+		tlsConfig := &tls.Config{
+			ServerName: opts.TLSServerName,
+			MinVersion: tls.VersionTLS12,
+		}
+
+		if opts.CACert != "" {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM([]byte(opts.CACert)) {
+				return nil, fmt.Errorf("Error parsing Redis CA certificate")
+			}
+			tlsConfig.RootCAs = pool
+		}
+
+		uOpts.TLSConfig = tlsConfig
+	}
+
+	switch {
+	case opts.Cluster && opts.MasterName != "":
+		return nil, fmt.Errorf("Error Redis Cluster and Sentinel are mutually exclusive")
+	case opts.Cluster && opts.DB != 0:
+		return nil, fmt.Errorf("Error Redis Cluster supports DB 0 only")
+	case opts.Cluster:
+		return redis.NewClusterClient(uOpts.Cluster()), nil
+	case opts.MasterName != "":
+		return redis.NewFailoverClient(uOpts.Failover()), nil
+	default:
+		return redis.NewClient(uOpts.Simple()), nil
+	}
+}
+
+/*
+Calls fn for every batch of keys matching the pattern. On a Redis Cluster every
+master is scanned, fn is never called concurrently.
+*/
+func scanKeys(ctx context.Context, client redis.UniversalClient, pattern string, fn func(keys []string) error) error {
+	var mu sync.Mutex
+
+	scan := func(ctx context.Context, c redis.Cmdable) error {
+		var cursor uint64
+		for {
+			keys, next, err := c.Scan(ctx, cursor, pattern, 100).Result()
+			if err != nil {
+				return fmt.Errorf("Error scanning Redis keys %s: %s", pattern, err)
+			}
+
+			if len(keys) > 0 {
+				mu.Lock()
+				err := fn(keys)
+				mu.Unlock()
+				if err != nil {
+					return err
+				}
+			}
+
+			if cursor = next; cursor == 0 {
+				return nil
+			}
+		}
+	}
+
+	if cluster, ok := client.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, master *redis.Client) error {
+			return scan(ctx, master)
+		})
+	}
+
+	return scan(ctx, client)
+}
+
+/*
+Returns true if the error means that Redis could not be reached, as opposed to
+an error reply of the server or a check failed by a script.
+*/
+func IsUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrUnavailable), errors.As(err, &netErr):
+		return true
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, redis.ErrClosed):
+		return true
+	case errors.Is(err, context.DeadlineExceeded):
+		return true
+	}
+	return strings.Contains(err.Error(), "connection pool timeout")
+}
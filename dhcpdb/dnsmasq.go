@@ -0,0 +1,73 @@
+package dhcpdb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Parses a dnsmasq lease file (dnsmasq.leases), made of lines
+"<expiry> <hwaddr> <address> <hostname> <client-id>", expiry being seconds
+since the epoch or 0 for infinite leases. DHCPv6 leases and the duid line
+are skipped.
+*/
+func ParseDnsmasqLeases(r io.Reader) (*LeaseFile, error) {
+	lf := new(LeaseFile)
+	scanner := bufio.NewScanner(r)
+
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[0] == "duid" {
+			continue
+		}
+
+		ipAddr := net.ParseIP(fields[2]).To4()
+		if ipAddr == nil {
+			continue
+		}
+
+		hwAddr, err := net.ParseMAC(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("Error invalid hardware address %s at line %d of dnsmasq lease file", fields[1], line)
+		}
+
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Error invalid expiry %s at line %d of dnsmasq lease file", fields[0], line)
+		}
+
+		lease := &Lease{IP: ipAddr, HwAddr: hwAddr}
+		if expiry != 0 {
+			lease.Expiry = time.Unix(expiry, 0)
+		}
+		lf.Leases = append(lf.Leases, lease)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return lf, nil
+}
+
+/*
+Writes the leases in dnsmasq format. Hosts are not written, dnsmasq keeps
+reservations in its configuration.
+*/
+func WriteDnsmasqLeases(w io.Writer, lf *LeaseFile) error {
+	writer := bufio.NewWriter(w)
+
+	for _, l := range lf.Leases {
+		expiry := int64(0)
+		if !l.Expiry.IsZero() {
+			expiry = l.Expiry.Unix()
+		}
+		fmt.Fprintf(writer, "%d %s %s * *\n", expiry, l.HwAddr, l.IP)
+	}
+
+	return writer.Flush()
+}
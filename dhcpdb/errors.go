@@ -0,0 +1,81 @@
+package dhcpdb
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+Kinds of the errors returned by the lease stores, to be tested with errors.Is.
+The detailed error keeps its own message, the kind tells the caller whether
+to NAK the client, stay silent and let it retransmit, or fall back to local
+state.
+*/
+var (
+	ErrPoolExhausted = errors.New("Error no more ip addresses available")
+	ErrConflict      = errors.New("Error address already leased")
+	ErrNotFound      = errors.New("Error lease not found")
+	ErrUnavailable   = errors.New("Error lease store unavailable")
+	ErrContention    = errors.New("Error too many concurrent updates")
+)
+
+// Classes of the errors, as reported by ErrorClass
+const (
+	ERROR_CLASS_EXHAUSTED   = "exhausted"
+	ERROR_CLASS_CONFLICT    = "conflict"
+	ERROR_CLASS_NOT_FOUND   = "notFound"
+	ERROR_CLASS_UNAVAILABLE = "unavailable"
+	ERROR_CLASS_CONTENTION  = "contention"
+	ERROR_CLASS_OTHER       = "other"
+)
+
+// error of one of the kinds above, with its own message and cause
+type kindError struct {
+	kind error
+	err  error
+}
+
+func newKindError(kind error, format string, args ...interface{}) error {
+	return &kindError{kind: kind, err: fmt.Errorf(format, args...)}
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+// marks as ErrUnavailable the errors due to Redis being unreachable
+func unavailable(err error) error {
+	if err == nil || errors.Is(err, ErrUnavailable) || !IsUnavailable(err) {
+		return err
+	}
+	return &kindError{kind: ErrUnavailable, err: err}
+}
+
+/*
+Returns the class of the error for metrics, empty for a nil error.
+*/
+func ErrorClass(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrPoolExhausted):
+		return ERROR_CLASS_EXHAUSTED
+	case errors.Is(err, ErrConflict):
+		return ERROR_CLASS_CONFLICT
+	case errors.Is(err, ErrNotFound):
+		return ERROR_CLASS_NOT_FOUND
+	case IsUnavailable(err):
+		return ERROR_CLASS_UNAVAILABLE
+	case errors.Is(err, ErrContention):
+		return ERROR_CLASS_CONTENTION
+	}
+	return ERROR_CLASS_OTHER
+}
@@ -0,0 +1,72 @@
+package dhcpdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	LEASE_EVENTS_CHANNEL = "leaseEvents"
+	LEASE_EVENT_BOUND    = "bound"
+	LEASE_EVENT_RELEASED = "released"
+	LEASE_EVENT_EXPIRED  = "expired"
+)
+
+/*
+LeaseEvent is published on the lease events channel of the keyspace when a
+binding changes. Origin is the replica id of the SharedContext making the
+change, empty for expiries.
+*/
+type LeaseEvent struct {
+	Type   string    `json:"type"`
+	IP     string    `json:"ip"`
+	MAC    string    `json:"mac"`
+	Time   time.Time `json:"time"`
+	Origin string    `json:"origin,omitempty"`
+}
+
+// publishes the event on the lease events channel of the keyspace
+func (sc *SharedContext) publishEvent(ctx context.Context, event *LeaseEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	if err := sc.client.Publish(ctx, sc.ks.Key(LEASE_EVENTS_CHANNEL), data).Err(); err != nil {
+		return fmt.Errorf("Error publishing %s event for %s: %s", event.Type, event.IP, err)
+	}
+
+	return nil
+}
+
+/*
+Calls fn for every lease event published by any replica, until the context is
+cancelled. Events published while the subscription is reconnecting are lost.
+*/
+func (sc *SharedContext) SubscribeEvents(ctx context.Context, fn func(*LeaseEvent)) error {
+	sub := sc.client.Subscribe(ctx, sc.ks.Key(LEASE_EVENTS_CHANNEL))
+	defer sub.Close()
+
+	if _, err := sub.Receive(ctx); err != nil {
+		return fmt.Errorf("Error subscribing to %s: %s", LEASE_EVENTS_CHANNEL, err)
+	}
+
+	ch := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case msg, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			event := new(LeaseEvent)
+			if err := json.Unmarshal([]byte(msg.Payload), event); err != nil {
+				continue
+			}
+			fn(event)
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package dhcpdb
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FILE_STORE_BIND       = "bind"
+	FILE_STORE_RELEASE    = "release"
+	FILE_STORE_MIN_RECORD = 1024
+)
+
+/*
+Entry of the file store log. Expiry is in nanoseconds since the epoch, zero
+for infinite leases.
+*/
+type fileRecord struct {
+	Op     string `json:"op"`
+	IP     string `json:"ip"`
+	MAC    string `json:"mac"`
+	Expiry int64  `json:"expiry,omitempty"`
+}
+
+/*
+FileStore is a LeaseStore persisted on a local append-only log, for edge
+deployments without Redis. Every line of the log is a JSON record preceded by
+its CRC32, so a torn write at the end of the file is detected and discarded on
+restart. Every record is synced before being applied to the in memory state and
+the log is compacted when it grows much bigger than the set of active leases.
+A failed write is truncated away, or the log rewritten, before the next one.
+*/
+type FileStore struct {
+	mu      sync.Mutex
+	mem     *MemStore
+	path    string
+	file    *os.File
+	records int
+	// end of the last record fully written and synced
+	offset int64
+	// set when a failed write could not be truncated away
+	torn bool
+}
+
+func OpenFileStore(path string, pool *Pool) (*FileStore, error) {
+	fs := &FileStore{
+		mem:  NewMemStore(pool),
+		path: path,
+	}
+
+	if err := fs.replay(); err != nil {
+		return nil, err
+	}
+
+	if err := fs.compact(); err != nil {
+		return nil, err
+	}
+
+	return fs, nil
+}
+
+func encodeRecord(rec *fileRecord) ([]byte, error) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(data), data)), nil
+}
+
+func decodeRecord(line string) (*fileRecord, error) {
+	pos := strings.IndexByte(line, ' ')
+	if pos == -1 {
+		return nil, fmt.Errorf("Error malformed record")
+	}
+
+	sum, err := strconv.ParseUint(line[:pos], 16, 32)
+	if err != nil || uint32(sum) != crc32.ChecksumIEEE([]byte(line[pos+1:])) {
+		return nil, fmt.Errorf("Error record checksum mismatch")
+	}
+
+	rec := new(fileRecord)
+	if err := json.Unmarshal([]byte(line[pos+1:]), rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// applies a record to the in memory state, without any check
+func (fs *FileStore) apply(rec *fileRecord) {
+	ipAddr := net.ParseIP(rec.IP)
+	if ipAddr == nil {
+		return
+	}
+
+	fs.mem.mu.Lock()
+	defer fs.mem.mu.Unlock()
+
+	pos, err := fs.mem.index(&ipAddr)
+	if err != nil {
+		return
+	}
+
+	switch rec.Op {
+	case FILE_STORE_BIND:
+		hwAddr, err := net.ParseMAC(rec.MAC)
+		if err != nil {
+			return
+		}
+		lease := &Lease{IP: ipAddr.To4(), HwAddr: hwAddr}
+		if rec.Expiry != 0 {
+			lease.Expiry = time.Unix(0, rec.Expiry)
+		}
+		fs.mem.leases[pos] = lease
+	case FILE_STORE_RELEASE:
+		if l, ok := fs.mem.leases[pos]; ok && l.HwAddr.String() == rec.MAC {
+			delete(fs.mem.leases, pos)
+		}
+	}
+}
+
+func (fs *FileStore) replay() error {
+	file, err := os.Open(fs.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Error opening lease file %s: %s", fs.path, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		rec, err := decodeRecord(scanner.Text())
+		if err != nil {
+			// torn write of the last record before a crash, what follows can't be trusted
+			break
+		}
+		fs.apply(rec)
+		fs.records++
+	}
+
+	return scanner.Err()
+}
+
+/*
+Rewrites the log with the active leases only. The new log is written to a
+temporary file and renamed over the old one, so a crash leaves either the old
+or the new log in place.
+*/
+func (fs *FileStore) compact() error {
+	tmpPath := fs.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("Error creating lease file %s: %s", tmpPath, err)
+	}
+
+	var leases []Lease
+	fs.mem.mu.Lock()
+	for pos := range fs.mem.leases {
+		if l := fs.mem.active(pos); l != nil {
+			leases = append(leases, *l)
+		}
+	}
+	fs.mem.mu.Unlock()
+
+	records, offset := 0, int64(0)
+	writer := bufio.NewWriter(tmp)
+	for _, l := range leases {
+		rec := &fileRecord{Op: FILE_STORE_BIND, IP: l.IP.String(), MAC: l.HwAddr.String()}
+		if !l.Expiry.IsZero() {
+			rec.Expiry = l.Expiry.UnixNano()
+		}
+
+		data, err := encodeRecord(rec)
+		if err == nil {
+			_, err = writer.Write(data)
+		}
+		if err != nil {
+			tmp.Close()
+			return fmt.Errorf("Error writing lease file %s: %s", tmpPath, err)
+		}
+		records++
+		offset += int64(len(data))
+	}
+
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Error writing lease file %s: %s", tmpPath, err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Error syncing lease file %s: %s", tmpPath, err)
+	}
+	tmp.Close()
+
+	if err := os.Rename(tmpPath, fs.path); err != nil {
+		return fmt.Errorf("Error replacing lease file %s: %s", fs.path, err)
+	}
+
+	if dir, err := os.Open(filepath.Dir(fs.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	if fs.file != nil {
+		fs.file.Close()
+	}
+
+	fs.file, err = os.OpenFile(fs.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("Error opening lease file %s: %s", fs.path, err)
+	}
+	fs.records = records
+	fs.offset = offset
+	fs.torn = false
+
+	return nil
+}
+
+/*
+Writes and syncs the record, then applies it to the in memory state. A failed
+write leaves the state untouched and the log is cut back to its last record, or
+rewritten from the state if that fails too, as a partial line would end the
+replay on restart.
+*/
+func (fs *FileStore) append(rec *fileRecord) error {
+	if fs.torn {
+		if err := fs.compact(); err != nil {
+			return err
+		}
+	}
+
+	data, err := encodeRecord(rec)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fs.file.Write(data); err != nil {
+		fs.truncate()
+		return fmt.Errorf("Error writing lease file %s: %s", fs.path, err)
+	}
+
+	if err := fs.file.Sync(); err != nil {
+		fs.truncate()
+		return fmt.Errorf("Error syncing lease file %s: %s", fs.path, err)
+	}
+
+	fs.offset += int64(len(data))
+	fs.records++
+	fs.apply(rec)
+
+	fs.mem.mu.Lock()
+	live := len(fs.mem.leases)
+	fs.mem.mu.Unlock()
+
+	if fs.records > FILE_STORE_MIN_RECORD && fs.records > 2*live {
+		return fs.compact()
+	}
+
+	return nil
+}
+
+// cuts the log back to the end of the last good record
+func (fs *FileStore) truncate() {
+	if err := fs.file.Truncate(fs.offset); err != nil {
+		fs.torn = true
+		return
+	}
+	if err := fs.file.Sync(); err != nil {
+		fs.torn = true
+	}
+}
+
+func (fs *FileStore) bindRecord(ipAddr *net.IP, hwAddr *net.HardwareAddr, leaseTime time.Duration) *fileRecord {
+	rec := &fileRecord{Op: FILE_STORE_BIND, IP: ipAddr.String(), MAC: hwAddr.String()}
+	if leaseTime > 0 {
+		rec.Expiry = time.Now().Add(leaseTime).UnixNano()
+	}
+	return rec
+}
+
+func (fs *FileStore) GetFirstAvailableAddress(ctx context.Context) (*net.IP, error) {
+	return fs.mem.GetFirstAvailableAddress(ctx)
+}
+
+// returns the active lease of the address, nil if the address is free
+func (fs *FileStore) lease(ipAddr *net.IP) (*Lease, error) {
+	fs.mem.mu.Lock()
+	defer fs.mem.mu.Unlock()
+
+	pos, err := fs.mem.index(ipAddr)
+	if err != nil {
+		return nil, err
+	}
+	return fs.mem.active(pos), nil
+}
+
+func (fs *FileStore) AddIPMACMapping(ctx context.Context, ipAddr *net.IP, hwAddr *net.HardwareAddr, leaseTime time.Duration) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	l, err := fs.lease(ipAddr)
+	if err != nil {
+		return err
+	}
+	if l != nil && l.HwAddr.String() != hwAddr.String() {
+		return newKindError(ErrConflict, "Error address %s already leased to %s", ipAddr, l.HwAddr)
+	}
+
+	return fs.append(fs.bindRecord(ipAddr, hwAddr, leaseTime))
+}
+
+func (fs *FileStore) RenewIPMACMapping(ctx context.Context, ipAddr *net.IP, hwAddr *net.HardwareAddr, leaseTime time.Duration) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	l, err := fs.lease(ipAddr)
+	if err != nil {
+		return err
+	}
+	if l == nil || l.HwAddr.String() != hwAddr.String() {
+		return newKindError(ErrNotFound, "Error address %s not leased to %s", ipAddr, hwAddr)
+	}
+
+	return fs.append(fs.bindRecord(ipAddr, hwAddr, leaseTime))
+}
+
+func (fs *FileStore) RemoveIPMapping(ctx context.Context, ipAddr *net.IP, hwAddr *net.HardwareAddr) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// the address may have been leased one more time to someone else
+	l, err := fs.lease(ipAddr)
+	if err != nil || l == nil || l.HwAddr.String() != hwAddr.String() {
+		return err
+	}
+
+	return fs.append(&fileRecord{Op: FILE_STORE_RELEASE, IP: ipAddr.String(), MAC: hwAddr.String()})
+}
+
+func (fs *FileStore) GetPortMACMapping(ctx context.Context, ipAddr *net.IP) (*net.HardwareAddr, error) {
+	return fs.mem.GetPortMACMapping(ctx, ipAddr)
+}
+
+func (fs *FileStore) ForEachMapping(ctx context.Context, fn func(*Lease) error) error {
+	return fs.mem.ForEachMapping(ctx, fn)
+}
+
+func (fs *FileStore) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.file.Close()
+}
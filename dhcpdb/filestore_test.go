@@ -0,0 +1,107 @@
+package dhcpdb
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileStore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "leases")
+	pool, err := NewPool([]string{"10.0.0.10-10.0.0.19"}, nil, net.IPv4Mask(255, 255, 255, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// returns the number of records of the log
+	records := func() int {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Count(string(data), "\n")
+	}
+
+	fs, err := OpenFileStore(path, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kept, released := net.IPv4(10, 0, 0, 10).To4(), net.IPv4(10, 0, 0, 11).To4()
+	hwAddr, other := testMAC, otherMAC
+	if err := fs.AddIPMACMapping(ctx, &kept, &hwAddr, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.AddIPMACMapping(ctx, &released, &other, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.RemoveIPMapping(ctx, &released, &other); err != nil {
+		t.Fatal(err)
+	}
+
+	// rejected changes are not logged
+	if err := fs.AddIPMACMapping(ctx, &kept, &other, time.Hour); !errors.Is(err, ErrConflict) {
+		t.Errorf("binding of a leased address: %v, want %v", err, ErrConflict)
+	}
+	if err := fs.RenewIPMACMapping(ctx, &released, &hwAddr, time.Hour); !errors.Is(err, ErrNotFound) {
+		t.Errorf("renewal of a released address: %v, want %v", err, ErrNotFound)
+	}
+	if err := fs.RemoveIPMapping(ctx, &kept, &other); err != nil {
+		t.Fatal(err)
+	}
+	if n := records(); n != 3 {
+		t.Errorf("%d records logged, want 3", n)
+	}
+
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// torn write of a record before a crash
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteString(`0badc0de {"op":"bind","ip":"10.0.0.12"`); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	fs, err = OpenFileStore(path, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+
+	if got := leasedTo(t, fs, kept.String()); got.String() != hwAddr.String() {
+		t.Errorf("%s leased to %s after the replay, want %s", kept, got, hwAddr)
+	}
+	for _, ip := range []string{released.String(), "10.0.0.12"} {
+		if got := leasedTo(t, fs, ip); got != nil {
+			t.Errorf("%s leased to %s after the replay, want none", ip, got)
+		}
+	}
+	if n := records(); n != 1 {
+		t.Errorf("%d records after the replay, want the active lease only", n)
+	}
+
+	// the log is compacted once renewals grow it past the threshold
+	for i := 0; i < 2*FILE_STORE_MIN_RECORD; i++ {
+		if err := fs.RenewIPMACMapping(ctx, &kept, &hwAddr, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := records(); n > FILE_STORE_MIN_RECORD {
+		t.Errorf("%d records after the renewals, want the log compacted", n)
+	}
+	if got := leasedTo(t, fs, kept.String()); got.String() != hwAddr.String() {
+		t.Errorf("%s leased to %s after the compaction, want %s", kept, got, hwAddr)
+	}
+}
@@ -0,0 +1,349 @@
+package dhcpdb
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/krolaw/dhcp4"
+)
+
+const (
+	FSCK_BATCH_SIZE = 256
+)
+
+/*
+Brings the state of an address back in line with its ip:<address> key, which
+is the authoritative one. ARGV[5] mapping score to use if the member of the
+live lease is missing, ARGV[6] 1 if the address is excluded, draining or
+claimed, ARGV[7..] mapping set members of the address found by the checker.
+Returns the number of fixes applied.
+*/
+var fsckRepairScript = redis.NewScript(poolVersionCheck + rangeBlockFunctions + `
+local cur = redis.call('GET', KEYS[6])
+local live = cur and (ARGV[4] .. '-' .. cur)
+local fixes = 0
+for i = 7, #ARGV - 1 do
+	if ARGV[i] ~= live then
+		fixes = fixes + redis.call('ZREM', KEYS[5], ARGV[i])
+	end
+end
+if cur then
+	if not redis.call('ZSCORE', KEYS[5], live) then
+		redis.call('ZADD', KEYS[5], ARGV[5], live)
+		fixes = fixes + 1
+	end
+	if redis.call('HGET', KEYS[7], ARGV[4]) ~= cur then
+		redis.call('HSET', KEYS[7], ARGV[4], cur)
+		fixes = fixes + 1
+	end
+else
+	fixes = fixes + redis.call('HDEL', KEYS[7], ARGV[4])
+end
+local want = 0
+if cur or ARGV[6] == '1' then
+	want = 1
+end
+if setPos(ARGV[1], want) ~= want then
+	fixes = fixes + 1
+end
+return fixes
+`)
+
+/*
+Recomputes the used bits counter and adds the blocks with free bits below
+the watermark to the free blocks set. ARGV[1] number of blocks.
+*/
+var fsckRecountScript = redis.NewScript(poolVersionCheck + `
+local blockBits = ` + strconv.Itoa(RANGE_BLOCK_BITS) + `
+local watermark = tonumber(redis.call('GET', KEYS[4]) or '0')
+local used = 0
+for block = 0, tonumber(ARGV[1]) - 1 do
+	local count = redis.call('BITCOUNT', KEYS[1] .. ':' .. block)
+	used = used + count
+	if count < blockBits and block < watermark then
+		redis.call('ZADD', KEYS[2], block, block)
+	end
+end
+redis.call('SET', KEYS[3], used)
+return used
+`)
+
+/*
+FsckReport lists the inconsistencies found between the leasing range, the
+mapping set, the owners index and the ip:<address> keys. Addresses are
+reported in their string form.
+*/
+type FsckReport struct {
+	OrphanedBits     []string // allocated in the leasing range without a lease
+	UnmarkedLeases   []string // leased but free in the leasing range
+	UnmarkedReserved []string // excluded or draining but free in the leasing range
+	DanglingMembers  []string // mapping set members without a matching lease
+	MissingMembers   []string // leases without a mapping set member
+	OwnerMismatches  []string // owners index entries not matching the lease
+	UsedCounter      int64    // value of the used bits counter
+	UsedBits         int64    // bits actually set into the leasing range
+	Repaired         int      // fixes applied, when repairing
+}
+
+func (r *FsckReport) Clean() bool {
+	return len(r.OrphanedBits) == 0 && len(r.UnmarkedLeases) == 0 && len(r.UnmarkedReserved) == 0 &&
+		len(r.DanglingMembers) == 0 && len(r.MissingMembers) == 0 && len(r.OwnerMismatches) == 0 &&
+		r.UsedCounter == r.UsedBits
+}
+
+// state of an address collected by the checker
+type fsckEntry struct {
+	lease   string // hardware address of the ip:<address> key
+	ttl     time.Duration
+	members []string
+	owner   string
+	bit     bool
+	claimed bool // claimed by a replica or offered, not bound yet
+}
+
+/*
+Checks the consistency of the dhcpdb structures, and repairs them if repair is
+true. The ip:<address> keys are the source of truth. Repairs are applied
+address by address through scripts re-reading the current state, so they are
+safe while the replicas keep serving requests: a lease bound or released after
+the scan is never undone.
+*/
+func (sc *SharedContext) Fsck(ctx context.Context, repair bool) (*FsckReport, error) {
+	if err := sc.LoadPool(ctx); err != nil {
+		return nil, err
+	}
+	pool := sc.Pool()
+
+	entries := make(map[string]*fsckEntry)
+	entry := func(ip string) *fsckEntry {
+		e, ok := entries[ip]
+		if !ok {
+			e = new(fsckEntry)
+			entries[ip] = e
+		}
+		return e
+	}
+
+	err := sc.ForEachMapping(ctx, func(l *Lease) error {
+		e := entry(l.IP.String())
+		e.lease = l.HwAddr.String()
+		if !l.Expiry.IsZero() {
+			e.ttl = time.Until(l.Expiry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := sc.client.ZRange(ctx, sc.ks.Key(IP_MAC_MAPPING_SET), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %s: %s", IP_MAC_MAPPING_SET, err)
+	}
+	for _, member := range members {
+		if pos := strings.IndexRune(member, '-'); pos != -1 {
+			e := entry(member[:pos])
+			e.members = append(e.members, member)
+		}
+	}
+
+	owners, err := sc.client.HGetAll(ctx, sc.ks.Key(IP_OWNERS_HASH)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %s: %s", IP_OWNERS_HASH, err)
+	}
+	for ip, mac := range owners {
+		entry(ip).owner = mac
+	}
+
+	claims, err := sc.client.ZRange(ctx, sc.ks.Key(ADDRESS_CLAIMS_SET), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %s: %s", ADDRESS_CLAIMS_SET, err)
+	}
+	for _, replicaID := range claims {
+		positions, err := sc.claimedPositions(ctx, replicaID)
+		if err != nil {
+			return nil, err
+		}
+		for _, pos := range positions {
+			if ip := pool.IPAt(pos); ip != nil {
+				entry(ip.String()).claimed = true
+			}
+		}
+	}
+
+	offers, err := sc.client.ZRange(ctx, sc.ks.Key(ADDRESS_OFFERS_SET), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %s: %s", ADDRESS_OFFERS_SET, err)
+	}
+	for _, member := range offers {
+		if pos, err := strconv.ParseUint(member, 10, 32); err == nil {
+			if ip := pool.IPAt(uint32(pos)); ip != nil {
+				entry(ip.String()).claimed = true
+			}
+		}
+	}
+
+	report := new(FsckReport)
+	if report.UsedBits, err = sc.scanRangeBits(ctx, pool, func(pos uint32) {
+		if ip := pool.IPAt(pos); ip != nil {
+			entry(ip.String()).bit = true
+		}
+	}); err != nil {
+		return nil, err
+	}
+
+	report.UsedCounter, err = sc.client.Get(ctx, sc.ks.Key(POOL_USED_COUNTER)).Int64()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("Error reading %s counter: %s", POOL_USED_COUNTER, err)
+	}
+
+	for _, r := range pool.reserved() {
+		for i := 0; i < int(r.Size()); i++ {
+			entry(dhcp4.IPAdd(r.Start, i).String())
+		}
+	}
+
+	ips := make([]string, 0, len(entries))
+	for ip := range entries {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+
+	for _, ip := range ips {
+		e := entries[ip]
+		ipAddr := net.ParseIP(ip)
+		if _, ok := pool.Index(ipAddr); !ok {
+			continue
+		}
+		reserved := pool.Excluded(ipAddr) || pool.DrainOf(ipAddr) != nil
+
+		dirty := false
+		switch {
+		case e.lease != "" && !e.bit:
+			report.UnmarkedLeases = append(report.UnmarkedLeases, ip)
+			dirty = true
+		case e.lease == "" && reserved && !e.bit:
+			report.UnmarkedReserved = append(report.UnmarkedReserved, ip)
+			dirty = true
+		case e.lease == "" && !reserved && !e.claimed && e.bit:
+			report.OrphanedBits = append(report.OrphanedBits, ip)
+			dirty = true
+		}
+
+		found := false
+		for _, member := range e.members {
+			if e.lease != "" && member == ip+"-"+e.lease {
+				found = true
+			} else {
+				report.DanglingMembers = append(report.DanglingMembers, member)
+				dirty = true
+			}
+		}
+		if e.lease != "" && !found {
+			report.MissingMembers = append(report.MissingMembers, ip)
+			dirty = true
+		}
+
+		if e.owner != e.lease {
+			report.OwnerMismatches = append(report.OwnerMismatches, ip)
+			dirty = true
+		}
+
+		if repair && dirty {
+			fixes, err := sc.repairAddress(ctx, ipAddr, e)
+			if err != nil {
+				return report, err
+			}
+			report.Repaired += fixes
+		}
+	}
+
+	if repair && report.UsedCounter != report.UsedBits {
+		err := sc.withFreshPool(ctx, func() error {
+			pool := sc.Pool()
+			return fsckRecountScript.Run(ctx, sc.client, append(rangeKeys(sc.ks), sc.ks.Key(POOL_VERSION)),
+				blockCount(pool.Size()), pool.Version).Err()
+		})
+		if err != nil {
+			return report, fmt.Errorf("Error recounting leasing range: %s", err)
+		}
+		report.Repaired++
+	}
+
+	return report, nil
+}
+
+func (sc *SharedContext) repairAddress(ctx context.Context, ipAddr net.IP, e *fsckEntry) (int, error) {
+	score := "+inf"
+	if e.ttl > 0 {
+		score = strconv.FormatInt(time.Now().Add(e.ttl).UnixNano(), 10)
+	}
+
+	var fixes int
+	err := sc.withFreshPool(ctx, func() error {
+		pool := sc.Pool()
+		pos, err := pool.rangePos(&ipAddr)
+		if err != nil {
+			return err
+		}
+
+		args := []interface{}{pos, "", "", ipAddr.String(), score, pool.keepBit(&ipAddr)}
+		if e.claimed {
+			args[5] = "1"
+		}
+		for _, member := range e.members {
+			args = append(args, member)
+		}
+		args = append(args, pool.Version)
+
+		fixes, err = fsckRepairScript.Run(ctx, sc.client, sc.mappingKeys(&ipAddr), args...).Int()
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Error repairing address %s: %s", ipAddr, err)
+	}
+
+	return fixes, nil
+}
+
+// calls fn with the position of every bit set into the leasing range of the
+// pool, padding excluded, and returns the number of bits set, padding included
+func (sc *SharedContext) scanRangeBits(ctx context.Context, pool *Pool, fn func(pos uint32)) (int64, error) {
+	size := pool.Size()
+	blocks := blockCount(size)
+	count := int64(0)
+
+	for first := uint32(0); first < blocks; first += FSCK_BATCH_SIZE {
+		pipe := sc.client.Pipeline()
+		cmds := make([]*redis.StringCmd, 0, FSCK_BATCH_SIZE)
+		for n := first; n < blocks && n < first+FSCK_BATCH_SIZE; n++ {
+			cmds = append(cmds, pipe.Get(ctx, blockKey(sc.ks, n)))
+		}
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return 0, fmt.Errorf("Error reading leasing range blocks: %s", err)
+		}
+
+		for i, cmd := range cmds {
+			base := uint64(first+uint32(i)) * RANGE_BLOCK_BITS
+			for j, b := range []byte(cmd.Val()) {
+				for bit := 0; b != 0 && bit < 8; bit++ {
+					if b&(0x80>>uint(bit)) == 0 {
+						continue
+					}
+					count++
+					if pos := base + uint64(j*8+bit); pos < uint64(size) {
+						fn(uint32(pos))
+					}
+				}
+			}
+		}
+	}
+
+	return count, nil
+}
@@ -0,0 +1,109 @@
+package dhcpdb
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestFsck(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestClient(t)
+	ks := NewKeyspace("test")
+
+	pool, err := NewPool([]string{"10.0.0.10-10.0.0.19"}, []string{"10.0.0.19"}, net.IPv4Mask(255, 255, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := InitPool(ctx, client, ks, pool, false); err != nil {
+		t.Fatal(err)
+	}
+	sc := NewSharedContext(client, ks, pool)
+
+	hwAddr := testMAC
+	for _, ip := range []string{"10.0.0.10", "10.0.0.11", "10.0.0.13"} {
+		ipAddr := net.ParseIP(ip).To4()
+		if err := sc.AddIPMACMapping(ctx, &ipAddr, &hwAddr, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := sc.Fsck(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Clean() {
+		t.Fatalf("Fsck() found %+v before any corruption, want clean", report)
+	}
+
+	block := blockKey(ks, 0)
+	corrupt := []error{
+		client.SetBit(ctx, block, 5, 1).Err(), // 10.0.0.15, counter left as is
+		client.SetBit(ctx, block, 0, 0).Err(), // 10.0.0.10 leased
+		client.SetBit(ctx, block, 9, 0).Err(), // 10.0.0.19 excluded
+		client.ZAdd(ctx, ks.Key(IP_MAC_MAPPING_SET), &redis.Z{Score: 0, Member: "10.0.0.12-" + hwAddr.String()}).Err(),
+		client.ZRem(ctx, ks.Key(IP_MAC_MAPPING_SET), "10.0.0.11-"+hwAddr.String()).Err(),
+		client.HSet(ctx, ks.Key(IP_OWNERS_HASH), "10.0.0.13", otherMAC.String()).Err(),
+	}
+	for _, err := range corrupt {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err = sc.Fsck(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checks := []struct {
+		name string
+		got  []string
+		want []string
+	}{
+		{"orphaned bits", report.OrphanedBits, []string{"10.0.0.15"}},
+		{"unmarked leases", report.UnmarkedLeases, []string{"10.0.0.10"}},
+		{"unmarked reserved", report.UnmarkedReserved, []string{"10.0.0.19"}},
+		{"dangling members", report.DanglingMembers, []string{"10.0.0.12-" + hwAddr.String()}},
+		{"missing members", report.MissingMembers, []string{"10.0.0.11"}},
+		{"owner mismatches", report.OwnerMismatches, []string{"10.0.0.13"}},
+	}
+	for _, c := range checks {
+		if !equalStrings(c.got, c.want) {
+			t.Errorf("%s %v, want %v", c.name, c.got, c.want)
+		}
+	}
+	// the padding of the block is counted as well
+	if report.UsedCounter != report.UsedBits+1 {
+		t.Errorf("used counter %d bits %d, want one more bit counted", report.UsedCounter, report.UsedBits)
+	}
+	if report.Repaired != 0 {
+		t.Errorf("%d fixes applied without repair", report.Repaired)
+	}
+
+	report, err = sc.Fsck(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Repaired == 0 {
+		t.Errorf("no fix applied when repairing %+v", report)
+	}
+
+	report, err = sc.Fsck(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Clean() {
+		t.Errorf("Fsck() found %+v after the repair, want clean", report)
+	}
+	for _, ip := range []string{"10.0.0.10", "10.0.0.11", "10.0.0.13"} {
+		if got := leasedTo(t, sc, ip); got.String() != hwAddr.String() {
+			t.Errorf("%s leased to %s after the repair, want %s", ip, got, hwAddr)
+		}
+	}
+	if used, _, err := sc.Usage(ctx); err != nil || used != 4 {
+		t.Errorf("Usage() = %d, %v after the repair, want 4", used, err)
+	}
+}
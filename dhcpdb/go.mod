@@ -3,6 +3,7 @@ module dhcpdb
 go 1.15
 
 require (
+	github.com/alicebob/miniredis/v2 v2.30.0
 	github.com/go-redis/redis/v8 v8.4.0
 	github.com/krolaw/dhcp4 v0.0.0-20190909130307-a50d88189771
 )
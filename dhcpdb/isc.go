@@ -0,0 +1,280 @@
+package dhcpdb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ISC_TIME_FORMAT = "2006/01/02 15:04:05"
+)
+
+// statement or block of an ISC dhcpd configuration or lease file
+type iscStatement struct {
+	tokens []string
+	block  []*iscStatement // nil for simple statements
+}
+
+// splits an ISC dhcpd file into words, quoted strings and punctuation
+func iscTokens(r io.Reader) ([]string, error) {
+	var tokens []string
+	reader := bufio.NewReader(r)
+
+	var word strings.Builder
+	flush := func() {
+		if word.Len() > 0 {
+			tokens = append(tokens, word.String())
+			word.Reset()
+		}
+	}
+
+	for {
+		c, _, err := reader.ReadRune()
+		if err == io.EOF {
+			flush()
+			return tokens, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case c == '#':
+			flush()
+			if _, err := reader.ReadString('\n'); err != nil && err != io.EOF {
+				return nil, err
+			}
+		case c == '"':
+			flush()
+			str, err := reader.ReadString('"')
+			if err != nil {
+				return nil, fmt.Errorf("Error unterminated string in lease file")
+			}
+			tokens = append(tokens, "\""+str)
+		case c == '{' || c == '}' || c == ';':
+			flush()
+			tokens = append(tokens, string(c))
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			flush()
+		default:
+			word.WriteRune(c)
+		}
+	}
+}
+
+// parses the statements up to the end of the current block
+func parseISCStatements(tokens []string, pos int) ([]*iscStatement, int, error) {
+	var res []*iscStatement
+	cur := new(iscStatement)
+
+	for pos < len(tokens) {
+		tok := tokens[pos]
+		pos++
+
+		switch tok {
+		case ";":
+			if len(cur.tokens) > 0 {
+				res = append(res, cur)
+			}
+			cur = new(iscStatement)
+		case "{":
+			block, next, err := parseISCStatements(tokens, pos)
+			if err != nil {
+				return nil, 0, err
+			}
+			if next > len(tokens) || tokens[next-1] != "}" {
+				return nil, 0, fmt.Errorf("Error unterminated block %s in lease file", strings.Join(cur.tokens, " "))
+			}
+			cur.block = block
+			res = append(res, cur)
+			cur = new(iscStatement)
+			pos = next
+		case "}":
+			return res, pos, nil
+		default:
+			cur.tokens = append(cur.tokens, tok)
+		}
+	}
+
+	return res, pos + 1, nil
+}
+
+// returns the value of a quoted string token or the token itself
+func unquote(tok string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(tok, "\""), "\"")
+}
+
+// parses a date statement value: weekday date time, epoch seconds or never
+func parseISCTime(tokens []string) (time.Time, error) {
+	switch {
+	case len(tokens) == 1 && tokens[0] == "never":
+		return time.Time{}, nil
+	case len(tokens) == 2 && tokens[0] == "epoch":
+		secs, err := strconv.ParseInt(tokens[1], 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Error invalid epoch time %s", tokens[1])
+		}
+		return time.Unix(secs, 0), nil
+	case len(tokens) == 3:
+		t, err := time.Parse(ISC_TIME_FORMAT, tokens[1]+" "+tokens[2])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Error invalid time %s %s", tokens[1], tokens[2])
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("Error invalid time %s", strings.Join(tokens, " "))
+}
+
+/*
+Parses an ISC dhcpd leases file. As dhcpd appends a new lease declaration at
+every change, the last declaration of an address wins; only the leases in
+active binding state are returned. Host declarations, deleted ones apart, are
+returned as hosts.
+*/
+func ParseISCLeases(r io.Reader) (*LeaseFile, error) {
+	tokens, err := iscTokens(r)
+	if err != nil {
+		return nil, err
+	}
+
+	stmts, _, err := parseISCStatements(tokens, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var order []string
+	leases := make(map[string]*Lease)
+	hosts := make(map[string]*Host)
+	var hostOrder []string
+
+	for _, stmt := range stmts {
+		if stmt.block == nil || len(stmt.tokens) != 2 {
+			continue
+		}
+
+		switch stmt.tokens[0] {
+		case "lease":
+			ipAddr := net.ParseIP(stmt.tokens[1])
+			if ipAddr == nil {
+				return nil, fmt.Errorf("Error invalid lease address %s", stmt.tokens[1])
+			}
+
+			lease := &Lease{IP: ipAddr.To4()}
+			active := true
+			for _, s := range stmt.block {
+				t := s.tokens
+				switch {
+				case len(t) >= 2 && t[0] == "ends":
+					if lease.Expiry, err = parseISCTime(t[1:]); err != nil {
+						return nil, err
+					}
+				case len(t) == 3 && t[0] == "binding" && t[1] == "state":
+					active = t[2] == "active"
+				case len(t) == 3 && t[0] == "hardware" && t[1] == "ethernet":
+					if lease.HwAddr, err = net.ParseMAC(t[2]); err != nil {
+						return nil, fmt.Errorf("Error invalid hardware address %s for lease %s", t[2], ipAddr)
+					}
+				}
+			}
+
+			key := ipAddr.String()
+			if _, ok := leases[key]; !ok {
+				order = append(order, key)
+			}
+			if active && lease.HwAddr != nil {
+				leases[key] = lease
+			} else {
+				leases[key] = nil
+			}
+		case "host":
+			host := &Host{Name: unquote(stmt.tokens[1])}
+			deleted := false
+			for _, s := range stmt.block {
+				t := s.tokens
+				switch {
+				case len(t) == 1 && t[0] == "deleted":
+					deleted = true
+				case len(t) == 3 && t[0] == "hardware" && t[1] == "ethernet":
+					if host.HwAddr, err = net.ParseMAC(t[2]); err != nil {
+						return nil, fmt.Errorf("Error invalid hardware address %s for host %s", t[2], host.Name)
+					}
+				case len(t) == 2 && t[0] == "fixed-address":
+					if host.IP = net.ParseIP(t[1]); host.IP == nil {
+						return nil, fmt.Errorf("Error invalid fixed address %s for host %s", t[1], host.Name)
+					}
+				}
+			}
+
+			if _, ok := hosts[host.Name]; !ok {
+				hostOrder = append(hostOrder, host.Name)
+			}
+			if !deleted && host.HwAddr != nil && host.IP != nil {
+				hosts[host.Name] = host
+			} else {
+				hosts[host.Name] = nil
+			}
+		}
+	}
+
+	lf := new(LeaseFile)
+	for _, key := range order {
+		if l := leases[key]; l != nil {
+			lf.Leases = append(lf.Leases, l)
+		}
+	}
+	for _, name := range hostOrder {
+		if h := hosts[name]; h != nil {
+			lf.Hosts = append(lf.Hosts, h)
+		}
+	}
+
+	return lf, nil
+}
+
+func formatISCTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	t = t.UTC()
+	return fmt.Sprintf("%d %s", t.Weekday(), t.Format(ISC_TIME_FORMAT))
+}
+
+/*
+Writes the leases and the hosts in ISC dhcpd leases file format, hosts being
+written as dynamic host declarations.
+*/
+func WriteISCLeases(w io.Writer, lf *LeaseFile) error {
+	writer := bufio.NewWriter(w)
+
+	fmt.Fprintf(writer, "# The format of this file is documented in the dhcpd.leases(5) manual page.\n")
+	fmt.Fprintf(writer, "# Exported by faasdhcp on %s\n\n", time.Now().UTC().Format(ISC_TIME_FORMAT))
+
+	for _, l := range lf.Leases {
+		fmt.Fprintf(writer, "lease %s {\n", l.IP)
+		fmt.Fprintf(writer, "  ends %s;\n", formatISCTime(l.Expiry))
+		fmt.Fprintf(writer, "  binding state active;\n")
+		fmt.Fprintf(writer, "  next binding state free;\n")
+		fmt.Fprintf(writer, "  hardware ethernet %s;\n", l.HwAddr)
+		fmt.Fprintf(writer, "}\n")
+	}
+
+	for _, h := range lf.Hosts {
+		name := h.Name
+		if name == "" {
+			name = strings.Replace(h.HwAddr.String(), ":", "-", -1)
+		} else if strings.ContainsAny(name, " \t#;{}") {
+			name = "\"" + name + "\""
+		}
+		fmt.Fprintf(writer, "host %s {\n", name)
+		fmt.Fprintf(writer, "  dynamic;\n")
+		fmt.Fprintf(writer, "  hardware ethernet %s;\n", h.HwAddr)
+		fmt.Fprintf(writer, "  fixed-address %s;\n", h.IP)
+		fmt.Fprintf(writer, "}\n")
+	}
+
+	return writer.Flush()
+}
@@ -0,0 +1,143 @@
+package dhcpdb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	KEA_HEADER            = "address,hwaddr,client_id,valid_lifetime,expire,subnet_id,fqdn_fwd,fqdn_rev,hostname,state,user_context"
+	KEA_INFINITE_LIFETIME = 0xffffffff
+	KEA_STATE_DEFAULT     = "0"
+	DEFAULT_KEA_SUBNET_ID = 1
+)
+
+/*
+Parses a Kea memfile lease file (kea-leases4.csv). Columns are located through
+the header, so files written by different Kea versions are accepted. As Kea
+appends a new row at every change, the last row of an address wins; only the
+leases in default (assigned) state are returned.
+*/
+func ParseKeaLeases(r io.Reader) (*LeaseFile, error) {
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return new(LeaseFile), nil
+	}
+
+	columns := make(map[string]int)
+	for i, name := range strings.Split(strings.TrimSpace(scanner.Text()), ",") {
+		columns[name] = i
+	}
+	for _, name := range []string{"address", "hwaddr", "valid_lifetime", "expire"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("Error Kea lease file without %s column", name)
+		}
+	}
+
+	lf := new(LeaseFile)
+	var order []string
+	leases := make(map[string]*Lease)
+
+	for line := 2; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		fields := strings.Split(text, ",")
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(fields) {
+				return strings.Replace(fields[i], "&#x2c", ",", -1)
+			}
+			return ""
+		}
+
+		ipAddr := net.ParseIP(field("address")).To4()
+		if ipAddr == nil {
+			return nil, fmt.Errorf("Error invalid address %s at line %d of Kea lease file", field("address"), line)
+		}
+		key := ipAddr.String()
+		if _, ok := leases[key]; !ok {
+			order = append(order, key)
+		}
+		leases[key] = nil
+
+		if state := field("state"); state != "" && state != KEA_STATE_DEFAULT {
+			continue
+		}
+
+		hwAddr, err := net.ParseMAC(field("hwaddr"))
+		if err != nil {
+			// leases identified by client id only can't be represented
+			continue
+		}
+
+		lifetime, err := strconv.ParseUint(field("valid_lifetime"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Error invalid valid_lifetime at line %d of Kea lease file", line)
+		}
+		expire, err := strconv.ParseInt(field("expire"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Error invalid expire at line %d of Kea lease file", line)
+		}
+
+		lease := &Lease{IP: ipAddr, HwAddr: hwAddr}
+		if lifetime != KEA_INFINITE_LIFETIME {
+			lease.Expiry = time.Unix(expire, 0)
+		}
+		leases[key] = lease
+
+		if id, err := strconv.ParseUint(field("subnet_id"), 10, 32); err == nil && lf.SubnetID == 0 {
+			lf.SubnetID = uint32(id)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, key := range order {
+		if l := leases[key]; l != nil {
+			lf.Leases = append(lf.Leases, l)
+		}
+	}
+
+	return lf, nil
+}
+
+/*
+Writes the leases in Kea memfile format. The valid lifetime of a lease is the
+time left before its expiry. Hosts are not written, Kea keeps reservations in
+its configuration.
+*/
+func WriteKeaLeases(w io.Writer, lf *LeaseFile) error {
+	writer := bufio.NewWriter(w)
+	now := time.Now()
+
+	subnetID := lf.SubnetID
+	if subnetID == 0 {
+		subnetID = DEFAULT_KEA_SUBNET_ID
+	}
+
+	fmt.Fprintln(writer, KEA_HEADER)
+	for _, l := range lf.Leases {
+		lifetime, expire := uint64(KEA_INFINITE_LIFETIME), now.Unix()+KEA_INFINITE_LIFETIME
+		if !l.Expiry.IsZero() {
+			left := l.Expiry.Sub(now) / time.Second
+			if left < 0 {
+				continue
+			}
+			lifetime, expire = uint64(left), l.Expiry.Unix()
+		}
+		fmt.Fprintf(writer, "%s,%s,,%d,%d,%d,0,0,,%s,\n", l.IP, l.HwAddr, lifetime, expire, subnetID, KEA_STATE_DEFAULT)
+	}
+
+	return writer.Flush()
+}
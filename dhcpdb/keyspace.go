@@ -0,0 +1,203 @@
+package dhcpdb
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	IP_KEY_PREFIX      = "ip:"
+	MIGRATION_LOCK     = "migrationLock"
+	MIGRATION_LOCK_TTL = 5 * time.Minute
+)
+
+/*
+Keyspace namespaces the Redis keys used by dhcpdb, so that several DHCP
+servers or pools can share the same Redis. The prefix is wrapped into a hash
+tag, so all the keys of a Keyspace belong to the same Redis Cluster slot and
+can be used together into scripts and transactions. The zero value is the
+legacy unprefixed keyspace.
+*/
+type Keyspace struct {
+	prefix string
+}
+
+func NewKeyspace(prefix string) Keyspace {
+	return Keyspace{prefix: prefix}
+}
+
+func (ks Keyspace) Prefix() string {
+	return ks.prefix
+}
+
+/*
+Returns the name of the key into the keyspace.
+*/
+func (ks Keyspace) Key(name string) string {
+	if ks.prefix == "" {
+		return name
+	}
+	return "{" + ks.prefix + "}:" + name
+}
+
+// returns the key holding the hardware address bound to the address
+func (ks Keyspace) ipKey(ipAddr string) string {
+	return ks.Key(IP_KEY_PREFIX + ipAddr)
+}
+
+// returns the address of a key returned by ipKey
+func (ks Keyspace) ipFromKey(key string) string {
+	return strings.TrimPrefix(key, ks.Key(IP_KEY_PREFIX))
+}
+
+// keys holding persistent state, moved by MigrateUnprefixedKeys
+var migratedKeys = []string{
+	FREE_BLOCKS_SET,
+	POOL_USED_COUNTER,
+	RANGE_WATERMARK,
+	IP_MAC_MAPPING_SET,
+	IP_OWNERS_HASH,
+	RESERVATIONS_HASH,
+	BOOTP_RANGE_BITSET,
+	BOOTP_BINDINGS_HASH,
+	ACL_DENIED_COUNTER,
+	RATE_LIMITED_COUNTER,
+	POOL_DEFINITION,
+	POOL_VERSION,
+	AUDIT_STREAM,
+	ADDRESS_CLAIMS_SET,
+	ADDRESS_OFFERS_SET,
+}
+
+var migratedPatterns = []string{
+	LEASING_RANGE_BITSET + ":*",
+	IP_KEY_PREFIX + "*",
+	ACL_ALLOW_LIST + ":*",
+	ACL_DENY_LIST + ":*",
+	RELAY_LEASES_PREFIX + ":*",
+	ADDRESS_CLAIM_PREFIX + ":*",
+}
+
+// KEYS[1] key to dump. Returns the dump and the time to live in milliseconds,
+// nil if the key does not exist
+var dumpKeyScript = redis.NewScript(`
+local dump = redis.call('DUMP', KEYS[1])
+local ttl = redis.call('PTTL', KEYS[1])
+if not dump or ttl == -2 then
+	return false
+end
+return {dump, ttl}
+`)
+
+// KEYS[1] migrationLock key, ARGV[1] lock token
+var releaseMigrationLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+/*
+Moves a key with its time to live, working across Cluster slots. The dump and
+the time to live are read at once, a key expired in the meantime is skipped.
+A key restored by another replica, the source being gone, counts as moved.
+*/
+func moveKey(ctx context.Context, client redis.UniversalClient, from, to string) error {
+	res, err := dumpKeyScript.Run(ctx, client, []string{from}).Result()
+	if err == redis.Nil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	values, ok := res.([]interface{})
+	if !ok || len(values) != 2 {
+		return fmt.Errorf("Error unexpected dump of key %s", from)
+	}
+	dump, _ := values[0].(string)
+	ttl, _ := values[1].(int64)
+	if ttl < 0 {
+		ttl = 0
+	}
+
+	err = client.Restore(ctx, to, time.Duration(ttl)*time.Millisecond, dump).Err()
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYKEY") {
+		if n, existsErr := client.Exists(ctx, from).Result(); existsErr == nil && n == 0 {
+			return nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return client.Del(ctx, from).Err()
+}
+
+// takes the migration lock, waiting for the replica holding it
+func lockMigration(ctx context.Context, client redis.UniversalClient, ks Keyspace) (string, error) {
+	id := make([]byte, 8)
+	rand.Read(id)
+	token := hex.EncodeToString(id)
+
+	for {
+		ok, err := client.SetNX(ctx, ks.Key(MIGRATION_LOCK), token, MIGRATION_LOCK_TTL).Result()
+		if err != nil {
+			return "", fmt.Errorf("Error taking migration lock: %s", err)
+		} else if ok {
+			return token, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+/*
+Moves the dhcpdb state stored with the legacy unprefixed keys into the
+keyspace. Keys already existing into the keyspace are not overwritten and make
+the migration fail. Replicas migrate one at a time under a lock, the ones
+coming later find nothing left to move. A leasing range stored as a single bitset is split into
+blocks keeping the positions, which match the pool positions if the pool
+starts where the legacy range did; when the keyspace has no pool definition,
+as with the first versions, InitPool rebuilds the bits from the migrated
+leases anyway at the first start.
+*/
+func MigrateUnprefixedKeys(ctx context.Context, client redis.UniversalClient, ks Keyspace) error {
+	if ks.prefix == "" {
+		return fmt.Errorf("Error migration requires a keyspace prefix")
+	}
+
+	token, err := lockMigration(ctx, client, ks)
+	if err != nil {
+		return err
+	}
+	defer releaseMigrationLockScript.Run(context.Background(), client, []string{ks.Key(MIGRATION_LOCK)}, token)
+
+	keys := append([]string{}, migratedKeys...)
+	for _, pattern := range migratedPatterns {
+		err := scanKeys(ctx, client, pattern, func(res []string) error {
+			keys = append(keys, res...)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, key := range keys {
+		if err := moveKey(ctx, client, key, ks.Key(key)); err != nil {
+			return fmt.Errorf("Error moving key %s to %s: %s", key, ks.Key(key), err)
+		}
+	}
+
+	return convertLegacyRange(ctx, client, LEASING_RANGE_BITSET, ks)
+}
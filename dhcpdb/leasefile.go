@@ -0,0 +1,254 @@
+package dhcpdb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"time"
+)
+
+const (
+	LEASE_FORMAT_ISC     = "isc"
+	LEASE_FORMAT_KEA     = "kea"
+	LEASE_FORMAT_DNSMASQ = "dnsmasq"
+)
+
+/*
+Host is a fixed address assigned to a hardware address, imported and exported
+as reservation.
+*/
+type Host struct {
+	Name   string
+	HwAddr net.HardwareAddr
+	IP     net.IP
+}
+
+/*
+LeaseFile is the content of a lease file of another DHCP server, independent
+from its format: the active bindings and the fixed address hosts. SubnetID is
+the subnet identifier used by the formats requiring one (Kea), zero if unknown.
+*/
+type LeaseFile struct {
+	Leases   []*Lease
+	Hosts    []*Host
+	SubnetID uint32
+}
+
+/*
+ImportConflict is an entry of a lease file that can't be imported.
+*/
+type ImportConflict struct {
+	IP     string `json:"ip"`
+	MAC    string `json:"mac"`
+	Reason string `json:"reason"`
+}
+
+type ImportReport struct {
+	DryRun    bool             `json:"dryRun"`
+	Leases    int              `json:"leases"`  // bindings imported (or importable when dry run)
+	Hosts     int              `json:"hosts"`   // reservations imported (or importable when dry run)
+	Expired   int              `json:"expired"` // bindings skipped because already expired
+	Conflicts []ImportConflict `json:"conflicts,omitempty"`
+}
+
+func (r *ImportReport) conflict(ip net.IP, hwAddr net.HardwareAddr, format string, args ...interface{}) {
+	r.Conflicts = append(r.Conflicts, ImportConflict{IP: ip.String(), MAC: hwAddr.String(), Reason: fmt.Sprintf(format, args...)})
+}
+
+/*
+Parses a lease file in the given format.
+*/
+func ParseLeaseFile(format string, r io.Reader) (*LeaseFile, error) {
+	switch format {
+	case LEASE_FORMAT_ISC:
+		return ParseISCLeases(r)
+	case LEASE_FORMAT_KEA:
+		return ParseKeaLeases(r)
+	case LEASE_FORMAT_DNSMASQ:
+		return ParseDnsmasqLeases(r)
+	}
+	return nil, fmt.Errorf("Error unknown lease file format %s", format)
+}
+
+/*
+Writes a lease file in the given format.
+*/
+func WriteLeaseFile(format string, w io.Writer, lf *LeaseFile) error {
+	switch format {
+	case LEASE_FORMAT_ISC:
+		return WriteISCLeases(w, lf)
+	case LEASE_FORMAT_KEA:
+		return WriteKeaLeases(w, lf)
+	case LEASE_FORMAT_DNSMASQ:
+		return WriteDnsmasqLeases(w, lf)
+	}
+	return fmt.Errorf("Error unknown lease file format %s", format)
+}
+
+/*
+Reads the active bindings of the store and, if reservations is not nil, the
+reservations, sorted by address.
+*/
+func ReadLeaseFile(ctx context.Context, store LeaseStore, reservations *Reservations) (*LeaseFile, error) {
+	lf := new(LeaseFile)
+
+	err := store.ForEachMapping(ctx, func(l *Lease) error {
+		lf.Leases = append(lf.Leases, l)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(lf.Leases, func(i, j int) bool {
+		return bytes.Compare(lf.Leases[i].IP.To16(), lf.Leases[j].IP.To16()) < 0
+	})
+
+	if reservations != nil {
+		all, err := reservations.All(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for mac, ip := range all {
+			hwAddr, err := net.ParseMAC(mac)
+			ipAddr := net.ParseIP(ip)
+			if err != nil || ipAddr == nil {
+				continue
+			}
+			lf.Hosts = append(lf.Hosts, &Host{HwAddr: hwAddr, IP: ipAddr})
+		}
+		sort.Slice(lf.Hosts, func(i, j int) bool {
+			return bytes.Compare(lf.Hosts[i].IP.To16(), lf.Hosts[j].IP.To16()) < 0
+		})
+	}
+
+	return lf, nil
+}
+
+/*
+Imports the bindings of a lease file into the store and its hosts into the
+reservations, through the store operations so that every structure stays
+consistent. Expired bindings are skipped; bindings outside of the pool or
+conflicting with a current lease and hosts conflicting with a current
+reservation are reported and left out. With dryRun nothing is written, the
+report lists what would be imported and the conflicts.
+*/
+func ImportLeaseFile(ctx context.Context, store LeaseStore, pool *Pool, reservations *Reservations, lf *LeaseFile, dryRun bool) (*ImportReport, error) {
+	report := &ImportReport{DryRun: dryRun}
+	now := time.Now()
+
+	for _, l := range lf.Leases {
+		ipAddr, hwAddr := l.IP.To4(), l.HwAddr
+
+		if !l.Expiry.IsZero() && !l.Expiry.After(now) {
+			report.Expired++
+			continue
+		}
+
+		if ipAddr == nil {
+			report.conflict(l.IP, hwAddr, "not an IPv4 address")
+			continue
+		} else if _, ok := pool.Index(ipAddr); !ok {
+			report.conflict(ipAddr, hwAddr, "out of pool")
+			continue
+		} else if pool.Excluded(ipAddr) {
+			report.conflict(ipAddr, hwAddr, "excluded from pool")
+			continue
+		} else if pool.DrainOf(ipAddr) != nil {
+			report.conflict(ipAddr, hwAddr, "draining")
+			continue
+		}
+
+		cur, err := store.GetPortMACMapping(ctx, &ipAddr)
+		if err != nil {
+			return report, err
+		}
+		if cur != nil && cur.String() != hwAddr.String() {
+			report.conflict(ipAddr, hwAddr, "leased to %s", cur)
+			continue
+		}
+
+		if !dryRun {
+			leaseTime := time.Duration(0)
+			if !l.Expiry.IsZero() {
+				leaseTime = l.Expiry.Sub(now)
+			}
+
+			if cur != nil {
+				err = store.RenewIPMACMapping(ctx, &ipAddr, &hwAddr, leaseTime)
+			} else {
+				err = store.AddIPMACMapping(ctx, &ipAddr, &hwAddr, leaseTime)
+			}
+			if err != nil {
+				report.conflict(ipAddr, hwAddr, "%s", err)
+				continue
+			}
+		}
+		report.Leases++
+	}
+
+	if len(lf.Hosts) == 0 {
+		return report, nil
+	}
+
+	if reservations == nil {
+		for _, h := range lf.Hosts {
+			report.conflict(h.IP, h.HwAddr, "reservations not available")
+		}
+		return report, nil
+	}
+
+	current, err := reservations.All(ctx)
+	if err != nil {
+		return report, err
+	}
+	reservedTo := make(map[string]string, len(current))
+	for mac, ip := range current {
+		reservedTo[ip] = mac
+	}
+
+	for _, h := range lf.Hosts {
+		mac, ip := h.HwAddr.String(), h.IP.String()
+
+		if cur, ok := current[mac]; ok && cur != ip {
+			report.conflict(h.IP, h.HwAddr, "reserved to %s", cur)
+			continue
+		}
+		if cur, ok := reservedTo[ip]; ok && cur != mac {
+			report.conflict(h.IP, h.HwAddr, "address reserved for %s", cur)
+			continue
+		}
+
+		ipAddr := h.IP.To4()
+		if ipAddr == nil {
+			report.conflict(h.IP, h.HwAddr, "not an IPv4 address")
+			continue
+		}
+		if _, ok := pool.Index(ipAddr); ok {
+			if !pool.Excluded(ipAddr) {
+				report.conflict(h.IP, h.HwAddr, "inside the DHCP pool, exclude it first")
+				continue
+			}
+			if leased, err := store.GetPortMACMapping(ctx, &ipAddr); err != nil {
+				return report, err
+			} else if leased != nil && leased.String() != mac {
+				report.conflict(h.IP, h.HwAddr, "leased to %s", leased)
+				continue
+			}
+		}
+
+		if !dryRun {
+			if err := reservations.Add(ctx, h.HwAddr, ipAddr); err != nil {
+				report.conflict(h.IP, h.HwAddr, "%s", err)
+				continue
+			}
+		}
+		current[mac], reservedTo[ip] = ip, mac
+		report.Hosts++
+	}
+
+	return report, nil
+}
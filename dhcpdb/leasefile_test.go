@@ -0,0 +1,172 @@
+package dhcpdb
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// returns the leases and hosts as "ip mac expiry" and "name mac ip" strings,
+// expiry being seconds since the epoch or never
+func leaseFileStrings(lf *LeaseFile) ([]string, []string) {
+	var leases, hosts []string
+	for _, l := range lf.Leases {
+		expiry := "never"
+		if !l.Expiry.IsZero() {
+			expiry = fmt.Sprint(l.Expiry.Unix())
+		}
+		leases = append(leases, fmt.Sprintf("%s %s %s", l.IP, l.HwAddr, expiry))
+	}
+	for _, h := range lf.Hosts {
+		hosts = append(hosts, fmt.Sprintf("%s %s %s", h.Name, h.HwAddr, h.IP))
+	}
+	return leases, hosts
+}
+
+type leaseFileTest struct {
+	name     string
+	input    string
+	leases   []string
+	hosts    []string
+	subnetID uint32
+	wantErr  bool
+}
+
+func runLeaseFileTests(t *testing.T, format string, tests []leaseFileTest) {
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lf, err := ParseLeaseFile(format, strings.NewReader(tt.input))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parsing succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsing error: %s", err)
+			}
+
+			leases, hosts := leaseFileStrings(lf)
+			if !reflect.DeepEqual(leases, tt.leases) {
+				t.Errorf("leases = %q, want %q", leases, tt.leases)
+			}
+			if !reflect.DeepEqual(hosts, tt.hosts) {
+				t.Errorf("hosts = %q, want %q", hosts, tt.hosts)
+			}
+			if lf.SubnetID != tt.subnetID {
+				t.Errorf("subnet id = %d, want %d", lf.SubnetID, tt.subnetID)
+			}
+		})
+	}
+}
+
+func TestParseISCLeases(t *testing.T) {
+	runLeaseFileTests(t, LEASE_FORMAT_ISC, []leaseFileTest{
+		{
+			name: "leases",
+			input: `# The format of this file is documented in the dhcpd.leases(5) manual page.
+lease 10.0.0.10 {
+  starts 4 2020/01/02 10:00:00;
+  ends 4 2020/01/02 12:00:00;
+  binding state active;
+  hardware ethernet 00:11:22:33:44:55;
+  client-hostname "laptop; home";
+}
+lease 10.0.0.11 {
+  ends never;
+  binding state active;
+  hardware ethernet 00:11:22:33:44:66;
+}
+lease 10.0.0.12 {
+  ends epoch 1600000000;
+  binding state active;
+  hardware ethernet 00:11:22:33:44:77;
+}
+`,
+			leases: []string{
+				"10.0.0.10 00:11:22:33:44:55 1577966400",
+				"10.0.0.11 00:11:22:33:44:66 never",
+				"10.0.0.12 00:11:22:33:44:77 1600000000",
+			},
+		},
+		{
+			name: "last declaration wins",
+			input: `lease 10.0.0.10 { ends never; binding state active; hardware ethernet 00:11:22:33:44:55; }
+lease 10.0.0.11 { ends never; binding state active; hardware ethernet 00:11:22:33:44:66; }
+lease 10.0.0.10 { ends never; binding state free; hardware ethernet 00:11:22:33:44:55; }
+lease 10.0.0.11 { ends never; binding state active; hardware ethernet 00:11:22:33:44:77; }
+`,
+			leases: []string{"10.0.0.11 00:11:22:33:44:77 never"},
+		},
+		{
+			name: "hosts",
+			input: `host "printer 1" {
+  dynamic;
+  hardware ethernet 00:aa:bb:cc:dd:ee;
+  fixed-address 10.0.0.200;
+}
+host old { dynamic; hardware ethernet 00:aa:bb:cc:dd:ff; fixed-address 10.0.0.201; }
+host old { dynamic; deleted; }
+`,
+			hosts: []string{"printer 1 00:aa:bb:cc:dd:ee 10.0.0.200"},
+		},
+		{name: "empty", input: ""},
+		{name: "invalid address", input: "lease 10.0.0 { ends never; }", wantErr: true},
+		{name: "invalid time", input: "lease 10.0.0.10 { ends 4 2020-01-02 12:00; }", wantErr: true},
+		{name: "invalid hardware address", input: "lease 10.0.0.10 { hardware ethernet 00:11; }", wantErr: true},
+		{name: "unterminated block", input: "lease 10.0.0.10 { ends never;", wantErr: true},
+		{name: "unterminated string", input: `host "printer { }`, wantErr: true},
+	})
+}
+
+func TestParseKeaLeases(t *testing.T) {
+	runLeaseFileTests(t, LEASE_FORMAT_KEA, []leaseFileTest{
+		{
+			name: "leases",
+			input: KEA_HEADER + `
+10.0.0.10,00:11:22:33:44:55,,3600,1600003600,7,0,0,laptop,0,
+10.0.0.11,00:11:22:33:44:66,01:02:03,4294967295,1600000000,7,0,0,,0,
+10.0.0.12,00:11:22:33:44:77,,3600,1600003600,7,0,0,,0,
+10.0.0.12,00:11:22:33:44:77,,0,1600000000,7,0,0,,2,
+10.0.0.13,,01:02:03,3600,1600003600,7,0,0,,0,
+`,
+			leases: []string{
+				"10.0.0.10 00:11:22:33:44:55 1600003600",
+				"10.0.0.11 00:11:22:33:44:66 never",
+			},
+			subnetID: 7,
+		},
+		{
+			name: "columns located through the header",
+			input: `hwaddr,expire,valid_lifetime,address
+00:11:22:33:44:55,1600003600,3600,10.0.0.10
+`,
+			leases: []string{"10.0.0.10 00:11:22:33:44:55 1600003600"},
+		},
+		{name: "empty", input: ""},
+		{name: "missing column", input: "address,hwaddr,expire\n", wantErr: true},
+		{name: "invalid address", input: KEA_HEADER + "\n10.0.0,00:11:22:33:44:55,,3600,1600003600,1,0,0,,0,\n", wantErr: true},
+		{name: "invalid lifetime", input: KEA_HEADER + "\n10.0.0.10,00:11:22:33:44:55,,forever,1600003600,1,0,0,,0,\n", wantErr: true},
+	})
+}
+
+func TestParseDnsmasqLeases(t *testing.T) {
+	runLeaseFileTests(t, LEASE_FORMAT_DNSMASQ, []leaseFileTest{
+		{
+			name: "leases",
+			input: `1600003600 00:11:22:33:44:55 10.0.0.10 laptop 01:00:11:22:33:44:55
+0 00:11:22:33:44:66 10.0.0.11 * *
+duid 00:01:00:01:26:9a:bc:de:00:11:22:33:44:55
+1600003600 1234 2001:db8::10 * 00:01:00:01
+`,
+			leases: []string{
+				"10.0.0.10 00:11:22:33:44:55 1600003600",
+				"10.0.0.11 00:11:22:33:44:66 never",
+			},
+		},
+		{name: "empty", input: ""},
+		{name: "invalid hardware address", input: "1600003600 00:11 10.0.0.10 * *\n", wantErr: true},
+		{name: "invalid expiry", input: "soon 00:11:22:33:44:55 10.0.0.10 * *\n", wantErr: true},
+	})
+}
@@ -0,0 +1,61 @@
+package dhcpdb
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	LOCAL_BLOCK_PREFIX      = "localBlock"
+	DEFAULT_LOCAL_BLOCK_TTL = time.Hour
+)
+
+/*
+Takes or renews the claim of a local block. KEYS[1] localBlock:<range> key.
+ARGV[1] replica identifier, ARGV[2] claim time to live in milliseconds.
+*/
+var claimLocalBlockScript = redis.NewScript(`
+local cur = redis.call('GET', KEYS[1])
+if cur and cur ~= ARGV[1] then
+	return redis.error_reply('CONFLICT ' .. cur)
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return 1
+`)
+
+// KEYS[1] localBlock:<range> key, ARGV[1] replica identifier
+var releaseLocalBlockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+/*
+Claims a range of addresses reserved to the replica, used to make new leases
+while Redis is unreachable, for ttl. Claiming a range held already renews the
+claim. Returns an ErrConflict error if another replica holds the range: the
+claim must be renewed before ttl elapses, and ttl must outlast the outages,
+since the range can be claimed by another replica once it expires.
+*/
+func (sc *SharedContext) ClaimLocalBlock(ctx context.Context, r IPRange, ttl time.Duration) error {
+	err := claimLocalBlockScript.Run(ctx, sc.client, []string{sc.ks.Key(LOCAL_BLOCK_PREFIX + ":" + r.String())},
+		sc.replicaID, ttl.Milliseconds()).Err()
+	if owner, ok := scriptError(err, "CONFLICT"); ok {
+		return newKindError(ErrConflict, "Error local block %s claimed by replica %s", r, owner)
+	}
+
+	return unavailable(err)
+}
+
+/*
+Gives back a local block claimed by the replica.
+*/
+func (sc *SharedContext) ReleaseLocalBlock(ctx context.Context, r IPRange) error {
+	err := releaseLocalBlockScript.Run(ctx, sc.client, []string{sc.ks.Key(LOCAL_BLOCK_PREFIX + ":" + r.String())},
+		sc.replicaID).Err()
+
+	return unavailable(err)
+}
@@ -0,0 +1,166 @@
+package dhcpdb
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+MemStore is a LeaseStore keeping the leases in process memory, suitable for
+single instance deployments and tests.
+*/
+type MemStore struct {
+	mu     sync.Mutex
+	pool   *Pool
+	leases map[uint32]*Lease
+}
+
+func NewMemStore(pool *Pool) *MemStore {
+	return &MemStore{
+		pool:   pool,
+		leases: make(map[uint32]*Lease),
+	}
+}
+
+func (ms *MemStore) index(ipAddr *net.IP) (uint32, error) {
+	pos, ok := ms.pool.Index(*ipAddr)
+	if !ok {
+		return 0, fmt.Errorf("Error address %s out of leasing range", ipAddr)
+	}
+	return pos, nil
+}
+
+// returns the lease at position pos if still active, removing it if expired
+func (ms *MemStore) active(pos uint32) *Lease {
+	l, ok := ms.leases[pos]
+	if !ok {
+		return nil
+	}
+	if !l.Expiry.IsZero() && time.Now().After(l.Expiry) {
+		delete(ms.leases, pos)
+		return nil
+	}
+	return l
+}
+
+func (ms *MemStore) GetFirstAvailableAddress(ctx context.Context) (*net.IP, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for pos := uint32(0); pos < ms.pool.Size(); pos++ {
+		if addr := ms.pool.IPAt(pos); ms.active(pos) == nil && ms.pool.Leasable(addr) {
+			return &addr, nil
+		}
+	}
+
+	return nil, ErrPoolExhausted
+}
+
+func (ms *MemStore) AddIPMACMapping(ctx context.Context, ipAddr *net.IP, hwAddr *net.HardwareAddr, leaseTime time.Duration) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	pos, err := ms.index(ipAddr)
+	if err != nil {
+		return err
+	}
+
+	if l := ms.active(pos); l != nil && l.HwAddr.String() != hwAddr.String() {
+		return newKindError(ErrConflict, "Error address %s already leased to %s", ipAddr, l.HwAddr)
+	}
+
+	lease := &Lease{
+		IP:     append(net.IP(nil), ipAddr.To4()...),
+		HwAddr: append(net.HardwareAddr(nil), *hwAddr...),
+	}
+	if leaseTime > 0 {
+		lease.Expiry = time.Now().Add(leaseTime)
+	}
+	ms.leases[pos] = lease
+
+	return nil
+}
+
+func (ms *MemStore) RenewIPMACMapping(ctx context.Context, ipAddr *net.IP, hwAddr *net.HardwareAddr, leaseTime time.Duration) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	pos, err := ms.index(ipAddr)
+	if err != nil {
+		return err
+	}
+
+	l := ms.active(pos)
+	if l == nil || l.HwAddr.String() != hwAddr.String() {
+		return newKindError(ErrNotFound, "Error address %s not leased to %s", ipAddr, hwAddr)
+	}
+
+	if leaseTime > 0 {
+		l.Expiry = time.Now().Add(leaseTime)
+	} else {
+		l.Expiry = time.Time{}
+	}
+
+	return nil
+}
+
+func (ms *MemStore) RemoveIPMapping(ctx context.Context, ipAddr *net.IP, hwAddr *net.HardwareAddr) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	pos, err := ms.index(ipAddr)
+	if err != nil {
+		return err
+	}
+
+	// the address may have been leased one more time to someone else
+	if l := ms.active(pos); l != nil && l.HwAddr.String() == hwAddr.String() {
+		delete(ms.leases, pos)
+	}
+
+	return nil
+}
+
+func (ms *MemStore) GetPortMACMapping(ctx context.Context, ipAddr *net.IP) (*net.HardwareAddr, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	pos, err := ms.index(ipAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := ms.active(pos)
+	if l == nil {
+		return nil, nil
+	}
+
+	hwAddr := append(net.HardwareAddr(nil), l.HwAddr...)
+	return &hwAddr, nil
+}
+
+func (ms *MemStore) ForEachMapping(ctx context.Context, fn func(*Lease) error) error {
+	ms.mu.Lock()
+	var leases []Lease
+	for pos := range ms.leases {
+		if l := ms.active(pos); l != nil {
+			leases = append(leases, *l)
+		}
+	}
+	ms.mu.Unlock()
+
+	for i := range leases {
+		if err := fn(&leases[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ms *MemStore) Close() error {
+	return nil
+}
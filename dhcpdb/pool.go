@@ -0,0 +1,421 @@
+package dhcpdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/krolaw/dhcp4"
+)
+
+const (
+	POOL_DEFINITION = "poolDefinition"
+	POOL_VERSION    = "poolVersion"
+)
+
+// Returned by InitPool when the pool definition is stored already
+var ErrPoolInitialized = errors.New("Error pool already initialized")
+
+/*
+IPRange is an inclusive range of IPv4 addresses.
+*/
+type IPRange struct {
+	Start net.IP `json:"start"`
+	End   net.IP `json:"end"`
+}
+
+/*
+Parses a range expressed as start-end, as a CIDR (network and broadcast
+addresses excluded) or as a single address.
+*/
+func ParseIPRange(str string) (IPRange, error) {
+	str = strings.TrimSpace(str)
+
+	if strings.Contains(str, "/") {
+		ip, ipNet, err := net.ParseCIDR(str)
+		if err != nil || ip.To4() == nil {
+			return IPRange{}, fmt.Errorf("Error invalid IPv4 CIDR %s", str)
+		}
+		ones, bits := ipNet.Mask.Size()
+		if bits-ones < 2 {
+			return IPRange{}, fmt.Errorf("Error CIDR %s has no host addresses", str)
+		}
+		network := ipNet.IP.To4()
+		return IPRange{
+			Start: dhcp4.IPAdd(network, 1),
+			End:   dhcp4.IPAdd(network, (1<<uint(bits-ones))-2),
+		}, nil
+	}
+
+	bounds := strings.SplitN(str, "-", 2)
+	start := net.ParseIP(strings.TrimSpace(bounds[0])).To4()
+	end := start
+	if len(bounds) == 2 {
+		end = net.ParseIP(strings.TrimSpace(bounds[1])).To4()
+	}
+
+	if start == nil || end == nil {
+		return IPRange{}, fmt.Errorf("Error invalid IPv4 range %s", str)
+	}
+	if dhcp4.IPLess(end, start) {
+		return IPRange{}, fmt.Errorf("Error range %s ends before its start", str)
+	}
+
+	return IPRange{Start: start, End: end}, nil
+}
+
+func (r IPRange) Size() uint32 {
+	return uint32(dhcp4.IPRange(r.Start, r.End))
+}
+
+func (r IPRange) Contains(ip net.IP) bool {
+	return dhcp4.IPInRange(r.Start, r.End, ip)
+}
+
+func (r IPRange) Overlaps(o IPRange) bool {
+	return !dhcp4.IPLess(r.End, o.Start) && !dhcp4.IPLess(o.End, r.Start)
+}
+
+func (r IPRange) String() string {
+	return fmt.Sprintf("%s-%s", r.Start, r.End)
+}
+
+/*
+Pool is the set of addresses distributed by the server: one or more disjoint
+ranges of the subnet minus the exclusion ranges (router, server, static
+hosts). The ranges are mapped, in order, onto a single index space, so every
+address has a position into the allocation bitset; excluded addresses are
+marked as allocated when the pool is initialized. Draining ranges are still
+part of the index space but no new lease is made on them.
+
+The definition is stored into Redis together with a version, incremented at
+every change, so the replicas can detect that their copy is stale.
+*/
+type Pool struct {
+	Ranges     []IPRange  `json:"ranges"`
+	Exclusions []IPRange  `json:"exclusions,omitempty"`
+	Draining   []Drain    `json:"draining,omitempty"`
+	Mask       net.IPMask `json:"mask"`
+	Version    int64      `json:"-"`
+}
+
+/*
+Drain is a range being removed from a pool. Clients bound to its addresses
+get renewals shortened to the deadline and a NAK after it; a zero deadline
+means renumbering, clients are moved to another address at their next renewal.
+*/
+type Drain struct {
+	Range    IPRange   `json:"range"`
+	Deadline time.Time `json:"deadline,omitempty"`
+}
+
+/*
+Returns a pool after checking that the ranges and the exclusions fit into the
+subnet defined by the mask.
+*/
+func NewPool(ranges []string, exclusions []string, mask net.IPMask) (*Pool, error) {
+	pool := &Pool{Mask: mask}
+
+	for _, rangeStr := range ranges {
+		if strings.TrimSpace(rangeStr) == "" {
+			continue
+		}
+		r, err := ParseIPRange(rangeStr)
+		if err != nil {
+			return nil, err
+		}
+		pool.Ranges = append(pool.Ranges, r)
+	}
+
+	for _, exclStr := range exclusions {
+		if strings.TrimSpace(exclStr) == "" {
+			continue
+		}
+		excl, err := ParseIPRange(exclStr)
+		if err != nil {
+			return nil, err
+		}
+		pool.Exclusions = append(pool.Exclusions, excl)
+	}
+
+	if err := pool.Validate(); err != nil {
+		return nil, err
+	}
+
+	return pool, nil
+}
+
+func (p *Pool) Validate() error {
+	if len(p.Mask) != net.IPv4len {
+		return fmt.Errorf("Error invalid IPv4 subnet mask %s", p.Mask)
+	}
+
+	if len(p.Ranges) == 0 {
+		return fmt.Errorf("Error pool without ranges")
+	}
+
+	network := p.Ranges[0].Start.Mask(p.Mask)
+	broadcast := make(net.IP, net.IPv4len)
+	for i := range broadcast {
+		broadcast[i] = network[i] | ^p.Mask[i]
+	}
+
+	for i, r := range p.Ranges {
+		if !r.Start.Mask(p.Mask).Equal(network) || !r.End.Mask(p.Mask).Equal(network) {
+			return fmt.Errorf("Error range %s doesn't fit into subnet %s/%s", r, network, net.IP(p.Mask))
+		}
+
+		if r.Contains(network) || r.Contains(broadcast) {
+			return fmt.Errorf("Error range %s includes network or broadcast address of subnet %s/%s", r, network, net.IP(p.Mask))
+		}
+
+		for _, other := range p.Ranges[:i] {
+			if r.Contains(other.Start) || other.Contains(r.Start) {
+				return fmt.Errorf("Error range %s overlaps range %s", r, other)
+			}
+		}
+	}
+
+	for _, excl := range p.Exclusions {
+		found := false
+		for _, r := range p.Ranges {
+			if r.Contains(excl.Start) && r.Contains(excl.End) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("Error exclusion %s out of pool ranges", excl)
+		}
+	}
+
+	return nil
+}
+
+/*
+Adds the address to the exclusions if it belongs to the pool.
+*/
+func (p *Pool) Exclude(ip net.IP) {
+	if ip = ip.To4(); ip != nil && !p.Excluded(ip) {
+		if _, ok := p.Index(ip); ok {
+			p.Exclusions = append(p.Exclusions, IPRange{Start: ip, End: ip})
+		}
+	}
+}
+
+func (p *Pool) Size() uint32 {
+	size := uint32(0)
+	for _, r := range p.Ranges {
+		size += r.Size()
+	}
+	return size
+}
+
+/*
+Returns the address at position pos of the pool.
+*/
+func (p *Pool) IPAt(pos uint32) net.IP {
+	for _, r := range p.Ranges {
+		if pos < r.Size() {
+			return dhcp4.IPAdd(r.Start, int(pos))
+		}
+		pos -= r.Size()
+	}
+	return nil
+}
+
+/*
+Returns the position of the address into the pool, false if the address does
+not belong to any of the pool ranges.
+*/
+func (p *Pool) Index(ip net.IP) (uint32, bool) {
+	if ip.To4() == nil {
+		return 0, false
+	}
+
+	offset := uint32(0)
+	for _, r := range p.Ranges {
+		if r.Contains(ip) {
+			return offset + uint32(dhcp4.IPRange(r.Start, ip)-1), true
+		}
+		offset += r.Size()
+	}
+	return 0, false
+}
+
+func (p *Pool) Excluded(ip net.IP) bool {
+	for _, excl := range p.Exclusions {
+		if excl.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Returns the drain the address belongs to, nil if the address is not draining.
+*/
+func (p *Pool) DrainOf(ip net.IP) *Drain {
+	for i := range p.Draining {
+		if p.Draining[i].Range.Contains(ip) {
+			return &p.Draining[i]
+		}
+	}
+	return nil
+}
+
+/*
+Returns true if the address can be leased: in range, not excluded and not
+draining.
+*/
+func (p *Pool) Leasable(ip net.IP) bool {
+	_, ok := p.Index(ip)
+	return ok && !p.Excluded(ip) && p.DrainOf(ip) == nil
+}
+
+// returns the ranges whose addresses are always marked as allocated
+func (p *Pool) reserved() []IPRange {
+	res := append([]IPRange(nil), p.Exclusions...)
+	for _, drain := range p.Draining {
+		res = append(res, drain.Range)
+	}
+	return res
+}
+
+// returns a copy of the pool, slices included
+func (p *Pool) clone() *Pool {
+	res := *p
+	res.Ranges = append([]IPRange(nil), p.Ranges...)
+	res.Exclusions = append([]IPRange(nil), p.Exclusions...)
+	res.Draining = append([]Drain(nil), p.Draining...)
+	return &res
+}
+
+// sets the bit at position pos of a Redis bitset (bit 0 is the most significant)
+func setBit(bitset []byte, pos uint32) {
+	bitset[pos>>3] |= 0x80 >> (pos & 7)
+}
+
+/*
+Initializes the leasing range blocks and the stored definition of the pool.
+The leases found into the keyspace are kept: their bits are set again and the
+owners index is rebuilt from them, so the pool can be initialized under live
+leases or after an upgrade. Excluded and draining addresses and the padding
+bits of the last block are marked as allocated as well, so they are never
+returned by the allocation; only the blocks holding allocated bits are
+created. Pending offers, the address claims of the replicas, which drop their
+local addresses at the next heartbeat, and the single bitset used before the
+leasing range was split into blocks are dropped.
+
+If the pool has been initialized already, by this or another replica,
+ErrPoolInitialized is returned unless force is true: the stored definition is
+then replaced, changes made through GrowPool, ShrinkPool or RenumberPool
+included.
+*/
+func InitPool(ctx context.Context, client redis.UniversalClient, ks Keyspace, pool *Pool, force bool) error {
+	defKey := ks.Key(POOL_DEFINITION)
+
+	var version *redis.IntCmd
+	err := client.Watch(ctx, func(tx *redis.Tx) error {
+		if !force {
+			n, err := tx.Exists(ctx, defKey).Result()
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				return ErrPoolInitialized
+			}
+		}
+
+		blocks := make(map[uint32][]byte)
+		used := int64(0)
+		mark := func(pos uint32) {
+			block, ok := blocks[pos/RANGE_BLOCK_BITS]
+			if !ok {
+				block = make([]byte, RANGE_BLOCK_BITS/8)
+				blocks[pos/RANGE_BLOCK_BITS] = block
+			}
+			if bit := pos % RANGE_BLOCK_BITS; block[bit>>3]&(0x80>>(bit&7)) == 0 {
+				setBit(block, bit)
+				used++
+			}
+		}
+
+		size := pool.Size()
+		for pos := uint64(size); pos < uint64(blockCount(size))*RANGE_BLOCK_BITS; pos++ {
+			mark(uint32(pos))
+		}
+
+		for _, r := range pool.reserved() {
+			first, _ := pool.Index(r.Start)
+			for pos := first; pos < first+r.Size(); pos++ {
+				mark(pos)
+			}
+		}
+
+		owners := make(map[string]interface{})
+		err := forEachLease(ctx, client, ks, func(l *Lease) error {
+			if pos, ok := pool.Index(l.IP); ok {
+				mark(pos)
+				owners[l.IP.String()] = l.HwAddr.String()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		var stale []string
+		for _, pattern := range []string{LEASING_RANGE_BITSET + ":*", ADDRESS_CLAIM_PREFIX + ":*"} {
+			err = scanKeys(ctx, client, ks.Key(pattern), func(keys []string) error {
+				stale = append(stale, keys...)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		def, err := json.Marshal(pool)
+		if err != nil {
+			return fmt.Errorf("Error encoding pool definition: %s", err)
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if len(stale) > 0 {
+				pipe.Del(ctx, stale...)
+			}
+			pipe.Del(ctx, ks.Key(LEASING_RANGE_BITSET), ks.Key(FREE_BLOCKS_SET), ks.Key(IP_OWNERS_HASH),
+				ks.Key(ADDRESS_OFFERS_SET), ks.Key(ADDRESS_CLAIMS_SET))
+			for n, block := range blocks {
+				pipe.Set(ctx, blockKey(ks, n), block, 0)
+			}
+			if len(owners) > 0 {
+				pipe.HSet(ctx, ks.Key(IP_OWNERS_HASH), owners)
+			}
+			pipe.Set(ctx, ks.Key(POOL_USED_COUNTER), used, 0)
+			pipe.Set(ctx, ks.Key(RANGE_WATERMARK), 0, 0)
+			pipe.Set(ctx, defKey, def, 0)
+			version = pipe.Incr(ctx, ks.Key(POOL_VERSION))
+			return nil
+		})
+		return err
+	}, defKey)
+
+	if err == redis.TxFailedErr {
+		// initialized by another replica in the meanwhile
+		return ErrPoolInitialized
+	} else if err == ErrPoolInitialized {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("Error during init of leasing range %s: %s", ks.Key(LEASING_RANGE_BITSET), err)
+	}
+	pool.Version = version.Val()
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package dhcpdb
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseIPRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		str     string
+		start   string
+		end     string
+		wantErr bool
+	}{
+		{name: "start-end", str: "10.0.0.10-10.0.0.20", start: "10.0.0.10", end: "10.0.0.20"},
+		{name: "spaces", str: " 10.0.0.10 - 10.0.0.20 ", start: "10.0.0.10", end: "10.0.0.20"},
+		{name: "single address", str: "10.0.0.5", start: "10.0.0.5", end: "10.0.0.5"},
+		{name: "CIDR", str: "10.0.1.0/24", start: "10.0.1.1", end: "10.0.1.254"},
+		{name: "CIDR host address", str: "10.0.1.77/30", start: "10.0.1.77", end: "10.0.1.78"},
+		{name: "CIDR without hosts", str: "10.0.1.0/31", wantErr: true},
+		{name: "IPv6 CIDR", str: "2001:db8::/64", wantErr: true},
+		{name: "reversed", str: "10.0.0.20-10.0.0.10", wantErr: true},
+		{name: "missing end", str: "10.0.0.10-", wantErr: true},
+		{name: "garbage", str: "pool", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := ParseIPRange(tt.str)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseIPRange(%q) = %s, want error", tt.str, r)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseIPRange(%q) error: %s", tt.str, err)
+			}
+			if !r.Start.Equal(net.ParseIP(tt.start)) || !r.End.Equal(net.ParseIP(tt.end)) {
+				t.Errorf("ParseIPRange(%q) = %s, want %s-%s", tt.str, r, tt.start, tt.end)
+			}
+		})
+	}
+}
+
+func TestPoolIndex(t *testing.T) {
+	pool, err := NewPool([]string{"10.0.0.10-10.0.0.19", "10.0.0.100-10.0.0.104"}, []string{"10.0.0.15"},
+		net.IPv4Mask(255, 255, 255, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip  string
+		pos uint32
+		ok  bool
+	}{
+		{ip: "10.0.0.10", pos: 0, ok: true},
+		{ip: "10.0.0.15", pos: 5, ok: true}, // excluded addresses keep their position
+		{ip: "10.0.0.19", pos: 9, ok: true},
+		{ip: "10.0.0.100", pos: 10, ok: true},
+		{ip: "10.0.0.104", pos: 14, ok: true},
+		{ip: "10.0.0.9"},
+		{ip: "10.0.0.20"},
+		{ip: "10.0.0.105"},
+		{ip: "10.0.1.10"},
+		{ip: "2001:db8::10"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			pos, ok := pool.Index(net.ParseIP(tt.ip))
+			if ok != tt.ok || pos != tt.pos {
+				t.Fatalf("Index(%s) = %d, %t, want %d, %t", tt.ip, pos, ok, tt.pos, tt.ok)
+			}
+			if ok && !pool.IPAt(pos).Equal(net.ParseIP(tt.ip)) {
+				t.Errorf("IPAt(%d) = %s, want %s", pos, pool.IPAt(pos), tt.ip)
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package dhcpdb
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	RATE_COUNTER_PREFIX   = "rate"
+	RELAY_LEASES_PREFIX   = "relayLeases"
+	LEASE_RELAYS_PREFIX   = "leaseRelays"
+	BURST_CLIENTS_PREFIX  = "burstClients"
+	RATE_LIMITED_COUNTER  = "rateLimited"
+	DEFAULT_RATE_WINDOW   = time.Second
+	RATE_REASON_MAC       = "mac"
+	RATE_REASON_RELAY     = "relay"
+	RATE_REASON_GLOBAL    = "global"
+	RATE_REASON_LEASE_CAP = "leaseCap"
+	RATE_REASON_BURST     = "burst"
+)
+
+/*
+Limits applied by a RateLimiter. A zero value disables the related check.
+Counters are kept per Window (fixed window), BurstClients is the number of
+distinct hardware addresses seen in a window above which new leases are
+refused.
+*/
+type RateLimits struct {
+	Window         time.Duration
+	PerMAC         int64
+	PerRelay       int64
+	Global         int64
+	MaxRelayLeases int64
+	BurstClients   int64
+}
+
+/*
+RateLimiter shares request counters between all the replicas through Redis in
+order to protect the leasing range from starvation.
+*/
+type RateLimiter struct {
+	client redis.UniversalClient
+	ks     Keyspace
+	limits RateLimits
+}
+
+/*
+Adds a lease to the ones bound through a relay. KEYS[1] relay leases sorted
+set, ARGV[1] lease expiry in nanoseconds (+inf for no expiry), ARGV[2]
+address. The set expires along with its longest lease, never before.
+*/
+var trackLeaseScript = redis.NewScript(`
+redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2])
+if redis.call('ZCOUNT', KEYS[1], '+inf', '+inf') > 0 then
+	redis.call('PERSIST', KEYS[1])
+	return 1
+end
+local last = redis.call('ZRANGE', KEYS[1], -1, -1, 'WITHSCORES')[2]
+redis.call('PEXPIREAT', KEYS[1], math.ceil(tonumber(last) / 1000000))
+return 1
+`)
+
+func NewRateLimiter(client redis.UniversalClient, ks Keyspace, limits RateLimits) *RateLimiter {
+	if limits.Window <= 0 {
+		limits.Window = DEFAULT_RATE_WINDOW
+	}
+
+	return &RateLimiter{
+		client: client,
+		ks:     ks,
+		limits: limits,
+	}
+}
+
+func (rl *RateLimiter) windowSuffix() string {
+	return strconv.FormatInt(time.Now().UnixNano()/int64(rl.limits.Window), 10)
+}
+
+/*
+Checks the request of the client against the configured limits. relayIds are
+the relay agent identifiers (circuit-id, remote-id) of the request, if any.
+When newLease is true the per relay lease cap and the burst detection are
+applied as well. Returns false and the reason if the request must be dropped.
+*/
+func (rl *RateLimiter) Allow(ctx context.Context, hwAddr net.HardwareAddr, relayIds []string, newLease bool) (bool, string, error) {
+	suffix := rl.windowSuffix()
+	ttl := 2 * rl.limits.Window
+
+	pipe := rl.client.Pipeline()
+	incr := func(key string) *redis.IntCmd {
+		cmd := pipe.Incr(ctx, key)
+		pipe.Expire(ctx, key, ttl)
+		return cmd
+	}
+
+	var macCmd, globalCmd, burstCmd *redis.IntCmd
+	var relayCmds, leaseCmds []*redis.IntCmd
+
+	if rl.limits.PerMAC > 0 {
+		macCmd = incr(rl.ks.Key(fmt.Sprintf("%s:mac:%s:%s", RATE_COUNTER_PREFIX, hwAddr, suffix)))
+	}
+
+	if rl.limits.PerRelay > 0 {
+		for _, id := range relayIds {
+			relayCmds = append(relayCmds, incr(rl.ks.Key(fmt.Sprintf("%s:relay:%s:%s", RATE_COUNTER_PREFIX, id, suffix))))
+		}
+	}
+
+	if rl.limits.Global > 0 {
+		globalCmd = incr(rl.ks.Key(fmt.Sprintf("%s:global:%s", RATE_COUNTER_PREFIX, suffix)))
+	}
+
+	if newLease && rl.limits.MaxRelayLeases > 0 {
+		now := strconv.FormatInt(time.Now().UnixNano(), 10)
+		for _, id := range relayIds {
+			key := rl.ks.Key(RELAY_LEASES_PREFIX + ":" + id)
+			pipe.ZRemRangeByScore(ctx, key, "-inf", now)
+			leaseCmds = append(leaseCmds, pipe.ZCard(ctx, key))
+		}
+	}
+
+	if newLease && rl.limits.BurstClients > 0 {
+		key := rl.ks.Key(BURST_CLIENTS_PREFIX + ":" + suffix)
+		pipe.PFAdd(ctx, key, hwAddr.String())
+		pipe.Expire(ctx, key, ttl)
+		burstCmd = pipe.PFCount(ctx, key)
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return false, "", fmt.Errorf("Error updating rate limiting counters: %s", err)
+	}
+
+	if macCmd != nil && macCmd.Val() > rl.limits.PerMAC {
+		return false, RATE_REASON_MAC, nil
+	}
+
+	for _, cmd := range relayCmds {
+		if cmd.Val() > rl.limits.PerRelay {
+			return false, RATE_REASON_RELAY, nil
+		}
+	}
+
+	if globalCmd != nil && globalCmd.Val() > rl.limits.Global {
+		return false, RATE_REASON_GLOBAL, nil
+	}
+
+	for _, cmd := range leaseCmds {
+		if cmd.Val() >= rl.limits.MaxRelayLeases {
+			return false, RATE_REASON_LEASE_CAP, nil
+		}
+	}
+
+	if burstCmd != nil && burstCmd.Val() > rl.limits.BurstClients {
+		return false, RATE_REASON_BURST, nil
+	}
+
+	return true, "", nil
+}
+
+// returns the relay identifiers the address was last bound through
+func (rl *RateLimiter) leaseRelays(ctx context.Context, ipAddr *net.IP) ([]string, error) {
+	ids, err := rl.client.Get(ctx, rl.ks.Key(LEASE_RELAYS_PREFIX+":"+ipAddr.String())).Result()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("Error reading relays of lease %s: %s", ipAddr, err)
+	}
+	return strings.Fields(ids), nil
+}
+
+/*
+Records a lease bound through the provided relay identifiers, used to enforce
+the per relay lease cap. The identifiers are kept along with the lease, since
+renewals unicast by the client and releases carry no relay agent information:
+a lease renewed without identifiers stays on the relays it was bound through.
+*/
+func (rl *RateLimiter) TrackLease(ctx context.Context, relayIds []string, ipAddr *net.IP, leaseTime time.Duration) error {
+	if rl.limits.MaxRelayLeases <= 0 {
+		return nil
+	}
+
+	prev, err := rl.leaseRelays(ctx, ipAddr)
+	if err != nil {
+		return err
+	}
+	if len(relayIds) == 0 {
+		relayIds = prev
+	}
+	if len(relayIds) == 0 {
+		return nil
+	}
+
+	expiry := "+inf"
+	if leaseTime > 0 {
+		expiry = strconv.FormatInt(time.Now().Add(leaseTime).UnixNano(), 10)
+	}
+
+	pipe := rl.client.Pipeline()
+	pipe.Set(ctx, rl.ks.Key(LEASE_RELAYS_PREFIX+":"+ipAddr.String()), strings.Join(relayIds, " "), leaseTime)
+	// the client moved behind another relay
+	for _, id := range prev {
+		if !containsString(relayIds, id) {
+			pipe.ZRem(ctx, rl.ks.Key(RELAY_LEASES_PREFIX+":"+id), ipAddr.String())
+		}
+	}
+	for _, id := range relayIds {
+		trackLeaseScript.Eval(ctx, pipe, []string{rl.ks.Key(RELAY_LEASES_PREFIX + ":" + id)}, expiry, ipAddr.String())
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("Error tracking lease %s for relay: %s", ipAddr, err)
+	}
+
+	return nil
+}
+
+/*
+Removes a released lease from the ones bound through its relays, the ones
+recorded by TrackLease and the relay identifiers of the release if any.
+*/
+func (rl *RateLimiter) ForgetLease(ctx context.Context, relayIds []string, ipAddr *net.IP) error {
+	if rl.limits.MaxRelayLeases <= 0 {
+		return nil
+	}
+
+	prev, err := rl.leaseRelays(ctx, ipAddr)
+	if err != nil {
+		return err
+	}
+	for _, id := range relayIds {
+		if !containsString(prev, id) {
+			prev = append(prev, id)
+		}
+	}
+
+	pipe := rl.client.Pipeline()
+	for _, id := range prev {
+		pipe.ZRem(ctx, rl.ks.Key(RELAY_LEASES_PREFIX+":"+id), ipAddr.String())
+	}
+	pipe.Del(ctx, rl.ks.Key(LEASE_RELAYS_PREFIX+":"+ipAddr.String()))
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("Error removing lease %s for relay: %s", ipAddr, err)
+	}
+
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Increments the counter of requests dropped for the given reason.
+*/
+func (rl *RateLimiter) CountLimited(ctx context.Context, reason string) error {
+	if err := rl.client.HIncrBy(ctx, rl.ks.Key(RATE_LIMITED_COUNTER), reason, 1).Err(); err != nil {
+		return fmt.Errorf("Error incrementing %s counter: %s", RATE_LIMITED_COUNTER, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package dhcpdb
+
+import (
+	"context"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestRelayLeases(t *testing.T) {
+	ctx := context.Background()
+	ipAddr := net.IPv4(10, 0, 0, 10).To4()
+
+	// returns the relays the address is counted for
+	relaysOf := func(t *testing.T, client redis.UniversalClient, ks Keyspace) []string {
+		var relays []string
+		for _, id := range []string{"circuit:01", "circuit:02", "remote:aa"} {
+			_, err := client.ZScore(ctx, ks.Key(RELAY_LEASES_PREFIX+":"+id), ipAddr.String()).Result()
+			if err == nil {
+				relays = append(relays, id)
+			} else if err != redis.Nil {
+				t.Fatal(err)
+			}
+		}
+		sort.Strings(relays)
+		return relays
+	}
+
+	tests := []struct {
+		name    string
+		bind    []string
+		renew   []string // relay ids of the renewal, nil if unicast by the client
+		release bool
+		want    []string
+	}{
+		{name: "bind", bind: []string{"circuit:01", "remote:aa"}, want: []string{"circuit:01", "remote:aa"}},
+		{name: "unicast renewal", bind: []string{"circuit:01"}, renew: []string{}, want: []string{"circuit:01"}},
+		{name: "moved to another relay", bind: []string{"circuit:01"}, renew: []string{"circuit:02"}, want: []string{"circuit:02"}},
+		{name: "release without relay ids", bind: []string{"circuit:01", "remote:aa"}, release: true},
+		{name: "release after unicast renewal", bind: []string{"circuit:01"}, renew: []string{}, release: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := newTestClient(t)
+			ks := NewKeyspace("test")
+			rl := NewRateLimiter(client, ks, RateLimits{MaxRelayLeases: 10})
+
+			if err := rl.TrackLease(ctx, tt.bind, &ipAddr, time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			if tt.renew != nil {
+				if err := rl.TrackLease(ctx, tt.renew, &ipAddr, time.Hour); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.release {
+				if err := rl.ForgetLease(ctx, nil, &ipAddr); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if got := relaysOf(t, client, ks); !equalStrings(got, tt.want) {
+				t.Errorf("lease counted for relays %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
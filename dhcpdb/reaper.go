@@ -0,0 +1,245 @@
+package dhcpdb
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	EXPIRED_EVENTS_PATTERN = "__keyevent@*__:expired"
+	DEFAULT_REAP_INTERVAL  = time.Minute
+)
+
+/*
+Reaper frees the addresses of the leases timed out in Redis. The ip:<address>
+keys expire on their own, the Reaper reacts to the expired-key notifications
+sent by Redis and, since notifications are not delivered while disconnected,
+periodically reconciles the mapping set, scored by expiry time, as fallback.
+All the replicas can run a Reaper: every expiry is processed exactly once.
+The addresses offered and not requested in time, and the ones claimed by
+replicas that stopped renewing their claims, are freed at the same pace, and
+the drained ranges left without leases are removed from the pool.
+*/
+type Reaper struct {
+	sc       *SharedContext
+	interval time.Duration
+	logger   *log.Logger
+	OnExpire func(*LeaseEvent) // called for every lease freed by this Reaper
+}
+
+func NewReaper(sc *SharedContext, interval time.Duration, logger *log.Logger) *Reaper {
+	if interval <= 0 {
+		interval = DEFAULT_REAP_INTERVAL
+	}
+
+	return &Reaper{
+		sc:       sc,
+		interval: interval,
+		logger:   logger,
+	}
+}
+
+/*
+Processes the expiries until the context is cancelled.
+*/
+func (r *Reaper) Run(ctx context.Context) error {
+	if err := r.enableNotifications(ctx); err != nil {
+		r.logger.Println(err)
+	}
+
+	keys := make(chan string, 1024)
+	for _, sub := range r.subscribe(ctx, keys) {
+		defer sub.Close()
+	}
+
+	// expiries missed while no Reaper was running
+	if _, err := r.Reconcile(ctx); err != nil {
+		r.logger.Println(err)
+	}
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case key := <-keys:
+			ipAddr := net.ParseIP(r.sc.ks.ipFromKey(key))
+			if _, ok := r.sc.Pool().Index(ipAddr); !ok {
+				continue
+			}
+			if _, err := r.reap(ctx, ipAddr, ""); err != nil {
+				r.logger.Println(err)
+			}
+		case <-ticker.C:
+			expired, err := r.Reconcile(ctx)
+			if err != nil {
+				r.logger.Println(err)
+			} else if expired > 0 {
+				r.logger.Printf("DHCP db reconciliation performed, %d mappings expired\n", expired)
+			}
+			if freed, err := r.sc.ExpireOffers(ctx); err != nil {
+				r.logger.Println(err)
+			} else if freed > 0 {
+				r.logger.Printf("%d addresses offered and not requested freed\n", freed)
+			}
+			if freed, err := r.sc.ReclaimBlocks(ctx); err != nil {
+				r.logger.Println(err)
+			} else if freed > 0 {
+				r.logger.Printf("%d addresses claimed by stopped replicas freed\n", freed)
+			}
+			if finalized, err := r.sc.FinalizeDrains(ctx); err != nil {
+				r.logger.Println(err)
+			} else if len(finalized) > 0 {
+				r.logger.Printf("Drained ranges %v removed from the pool\n", finalized)
+			}
+		}
+	}
+}
+
+// enables the expired events notifications, keeping the already enabled ones
+func (r *Reaper) enableNotifications(ctx context.Context) error {
+	enable := func(ctx context.Context, client redis.Cmdable) error {
+		res, err := client.ConfigGet(ctx, "notify-keyspace-events").Result()
+		if err != nil {
+			return fmt.Errorf("Error reading keyspace notifications configuration: %s", err)
+		}
+
+		flags := ""
+		if len(res) == 2 {
+			flags, _ = res[1].(string)
+		}
+		if strings.Contains(flags, "E") && (strings.Contains(flags, "x") || strings.Contains(flags, "A")) {
+			return nil
+		}
+
+		if err := client.ConfigSet(ctx, "notify-keyspace-events", flags+"Ex").Err(); err != nil {
+			return fmt.Errorf("Error enabling keyspace notifications: %s", err)
+		}
+		return nil
+	}
+
+	if cluster, ok := r.sc.client.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, master *redis.Client) error {
+			return enable(ctx, master)
+		})
+	}
+	return enable(ctx, r.sc.client)
+}
+
+// subscribes to the expired events of every master, sending the expired ip keys to keys
+func (r *Reaper) subscribe(ctx context.Context, keys chan<- string) []*redis.PubSub {
+	var subs []*redis.PubSub
+
+	if cluster, ok := r.sc.client.(*redis.ClusterClient); ok {
+		// notifications are local to the node holding the key
+		var mu sync.Mutex
+		err := cluster.ForEachMaster(ctx, func(_ context.Context, master *redis.Client) error {
+			mu.Lock()
+			defer mu.Unlock()
+			subs = append(subs, master.PSubscribe(ctx, EXPIRED_EVENTS_PATTERN))
+			return nil
+		})
+		if err != nil {
+			r.logger.Printf("Error subscribing to expired events: %s\n", err)
+		}
+	} else {
+		subs = append(subs, r.sc.client.PSubscribe(ctx, EXPIRED_EVENTS_PATTERN))
+	}
+
+	prefix := r.sc.ks.ipKey("")
+	for _, sub := range subs {
+		go func(ch <-chan *redis.Message) {
+			for msg := range ch {
+				if !strings.HasPrefix(msg.Payload, prefix) {
+					continue
+				}
+				select {
+				case keys <- msg.Payload:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(sub.Channel())
+	}
+
+	return subs
+}
+
+/*
+Frees the addresses of all the mappings expired according to the mapping set
+and not reaped yet. Returns the number of leases freed.
+*/
+func (r *Reaper) Reconcile(ctx context.Context) (int, error) {
+	now := fmt.Sprintf("%d", time.Now().UnixNano())
+	members, err := r.sc.client.ZRangeByScore(ctx, r.sc.ks.Key(IP_MAC_MAPPING_SET), &redis.ZRangeBy{Min: "-inf", Max: now}).Result()
+	if err != nil {
+		return 0, fmt.Errorf("Error obtaining Redis set elements: %s", IP_MAC_MAPPING_SET)
+	}
+
+	expired := 0
+	for _, member := range members {
+		pos := strings.IndexRune(member, '-')
+		if pos == -1 {
+			continue
+		}
+
+		ipAddr := net.ParseIP(member[:pos])
+		hwAddr, err := net.ParseMAC(member[pos+1:])
+		if ipAddr == nil || err != nil {
+			continue
+		}
+
+		ok, err := r.reap(ctx, ipAddr, hwAddr.String())
+		if err != nil {
+			r.logger.Println(err)
+			continue
+		}
+		if ok {
+			expired++
+		}
+	}
+
+	return expired, nil
+}
+
+// frees the address if its lease expired, returns true if this call freed it
+func (r *Reaper) reap(ctx context.Context, ipAddr net.IP, hwAddr string) (bool, error) {
+	sc := r.sc
+
+	var mac string
+	err := sc.withFreshPool(ctx, func() error {
+		pool := sc.Pool()
+		pos, err := pool.rangePos(&ipAddr)
+		if err != nil {
+			return err
+		}
+
+		mac, err = reapScript.Run(ctx, sc.client, sc.mappingKeys(&ipAddr), pos, hwAddr, "", ipAddr.String(),
+			pool.keepBit(&ipAddr), pool.Version).Text()
+		return err
+	})
+	if err == redis.Nil {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("Error reaping lease of %s: %s", ipAddr, err)
+	}
+
+	event := &LeaseEvent{Type: LEASE_EVENT_EXPIRED, IP: ipAddr.String(), MAC: mac, Time: time.Now()}
+	if err := sc.publishEvent(ctx, event); err != nil {
+		r.logger.Println(err)
+	}
+	if r.OnExpire != nil {
+		r.OnExpire(event)
+	}
+
+	return true, nil
+}
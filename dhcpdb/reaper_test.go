@@ -0,0 +1,60 @@
+package dhcpdb
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestReaperReconcile(t *testing.T) {
+	ctx := context.Background()
+	client, mr := newTestClient(t)
+	sc := newTestContext(t, client, "10.0.0.10-10.0.0.12")
+
+	var expired []*LeaseEvent
+	reaper := NewReaper(sc, 0, log.New(ioutil.Discard, "", 0))
+	reaper.OnExpire = func(event *LeaseEvent) { expired = append(expired, event) }
+
+	short, long := allocate(t, sc), allocate(t, sc)
+	hwAddr, other := testMAC, otherMAC
+	if err := sc.AddIPMACMapping(ctx, &short, &hwAddr, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := sc.AddIPMACMapping(ctx, &long, &other, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// the ip key of a live lease keeps it from being reaped
+	if ok, err := reaper.reap(ctx, short, ""); err != nil || ok {
+		t.Fatalf("reap(%s) = %v, %v on a live lease, want false", short, ok, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	mr.FastForward(time.Second)
+
+	if n, err := reaper.Reconcile(ctx); err != nil || n != 1 {
+		t.Fatalf("Reconcile() = %d, %v, want 1", n, err)
+	}
+	if len(expired) != 1 || expired[0].IP != short.String() || expired[0].MAC != hwAddr.String() {
+		t.Errorf("expired events %+v, want one of %s to %s", expired, short, hwAddr)
+	}
+	if got := leasedTo(t, sc, short.String()); got != nil {
+		t.Errorf("%s leased to %s after its expiry, want none", short, got)
+	}
+	if got := leasedTo(t, sc, long.String()); got.String() != other.String() {
+		t.Errorf("%s leased to %s, want %s", long, got, other)
+	}
+
+	// every expiry is processed once
+	if n, err := reaper.Reconcile(ctx); err != nil || n != 0 {
+		t.Errorf("second Reconcile() = %d, %v, want 0", n, err)
+	}
+	if ok, err := reaper.reap(ctx, short, hwAddr.String()); err != nil || ok {
+		t.Errorf("reap(%s) = %v, %v of a reaped lease, want false", short, ok, err)
+	}
+	if used, _, err := sc.Usage(ctx); err != nil || used != 1 {
+		t.Errorf("Usage() = %d, %v after the expiry, want 1", used, err)
+	}
+}
@@ -0,0 +1,80 @@
+package dhcpdb
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	RESERVATIONS_HASH = "reservations"
+)
+
+/*
+Reservations maps hardware addresses to fixed IP addresses, shared between
+all the replicas through a Redis hash.
+*/
+type Reservations struct {
+	client redis.UniversalClient
+	ks     Keyspace
+}
+
+func NewReservations(client redis.UniversalClient, ks Keyspace) *Reservations {
+	return &Reservations{client: client, ks: ks}
+}
+
+/*
+Returns the reservations sharing the Redis client and keyspace of the context.
+*/
+func (sc *SharedContext) Reservations() *Reservations {
+	return NewReservations(sc.client, sc.ks)
+}
+
+func (r *Reservations) Add(ctx context.Context, hwAddr net.HardwareAddr, ipAddr net.IP) error {
+	if err := r.client.HSet(ctx, r.ks.Key(RESERVATIONS_HASH), hwAddr.String(), ipAddr.String()).Err(); err != nil {
+		return fmt.Errorf("Error adding reservation %s - %s: %s", hwAddr, ipAddr, err)
+	}
+
+	return nil
+}
+
+func (r *Reservations) Remove(ctx context.Context, hwAddr net.HardwareAddr) error {
+	if err := r.client.HDel(ctx, r.ks.Key(RESERVATIONS_HASH), hwAddr.String()).Err(); err != nil {
+		return fmt.Errorf("Error removing reservation for %s: %s", hwAddr, err)
+	}
+
+	return nil
+}
+
+/*
+Returns the address reserved to the hardware address, or nil if there is none.
+*/
+func (r *Reservations) Get(ctx context.Context, hwAddr net.HardwareAddr) (*net.IP, error) {
+	res, err := r.client.HGet(ctx, r.ks.Key(RESERVATIONS_HASH), hwAddr.String()).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Error reading reservation for %s: %s", hwAddr, err)
+	}
+
+	ipAddr := net.ParseIP(res)
+	if ipAddr == nil {
+		return nil, fmt.Errorf("Error invalid address %s reserved for %s", res, hwAddr)
+	}
+
+	return &ipAddr, nil
+}
+
+/*
+Returns all the reservations as a map from hardware address to IP address.
+*/
+func (r *Reservations) All(ctx context.Context) (map[string]string, error) {
+	res, err := r.client.HGetAll(ctx, r.ks.Key(RESERVATIONS_HASH)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading Redis hash %s: %s", RESERVATIONS_HASH, err)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,391 @@
+package dhcpdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/krolaw/dhcp4"
+)
+
+const (
+	MAX_POOL_UPDATE_ATTEMPTS = 5
+)
+
+/*
+Updates the stored pool definition and sets runs of bits of the leasing
+range, if the pool version is the expected one. The blocks past the end of a
+pool cut short are deleted, as blocks beyond the last one must not exist.
+KEYS[1..4] leasing range keys (see the SharedContext scripts), KEYS[5] pool
+definition, KEYS[6] pool version.
+ARGV[1] new definition, ARGV[2] and ARGV[3] new and old number of blocks, then
+(first, last, bit) triples, then the version.
+Returns the new version.
+*/
+var poolUpdateScript = redis.NewScript(poolVersionCheck + rangeBlockFunctions + `
+for block = tonumber(ARGV[2]), tonumber(ARGV[3]) - 1 do
+	local key = KEYS[1] .. ':' .. block
+	redis.call('DECRBY', KEYS[3], redis.call('BITCOUNT', key))
+	redis.call('DEL', key)
+	redis.call('ZREM', KEYS[2], block)
+end
+if tonumber(redis.call('GET', KEYS[4]) or '0') > tonumber(ARGV[2]) then
+	redis.call('SET', KEYS[4], ARGV[2])
+end
+for i = 4, #ARGV - 1, 3 do
+	local bit = tonumber(ARGV[i + 2])
+	for pos = tonumber(ARGV[i]), tonumber(ARGV[i + 1]) do
+		setPos(pos, bit)
+	end
+end
+redis.call('SET', KEYS[5], ARGV[1])
+return redis.call('INCR', KEYS[6])
+`)
+
+// run of consecutive bitset positions set to the same value
+type bitRun struct {
+	first uint32
+	last  uint32
+	bit   int
+}
+
+/*
+Loads the pool definition stored into Redis, replacing the local one. If no
+definition has been stored yet, the local pool is kept. The pool in use is
+never modified: the new one replaces it as a whole, so the pools returned by
+Pool stay consistent while other goroutines reload it.
+*/
+func (sc *SharedContext) LoadPool(ctx context.Context) error {
+	res, err := sc.client.MGet(ctx, sc.ks.Key(POOL_DEFINITION), sc.ks.Key(POOL_VERSION)).Result()
+	if err != nil {
+		return fmt.Errorf("Error reading pool definition: %s", err)
+	}
+
+	var version int64
+	if str, ok := res[1].(string); ok {
+		if version, err = strconv.ParseInt(str, 10, 64); err != nil {
+			return fmt.Errorf("Error invalid pool version %s", str)
+		}
+	}
+
+	def, ok := res[0].(string)
+	if !ok {
+		pool := sc.Pool().clone()
+		pool.Version = version
+		sc.pool.Store(pool)
+		return nil
+	}
+
+	pool := new(Pool)
+	if err := json.Unmarshal([]byte(def), pool); err != nil {
+		return fmt.Errorf("Error decoding pool definition: %s", err)
+	}
+	pool.Version = version
+
+	sc.pool.Store(pool)
+	return nil
+}
+
+/*
+Returns the current pool definition. The returned pool must not be modified,
+operations spanning several calls should use the same returned pool.
+*/
+func (sc *SharedContext) Pool() *Pool {
+	return sc.pool.Load().(*Pool)
+}
+
+/*
+Applies change to a copy of the freshest pool definition and stores the result
+together with the bit updates returned by change, retrying if another replica
+changes the pool concurrently.
+*/
+func (sc *SharedContext) updatePool(ctx context.Context, change func(pool *Pool) ([]bitRun, error)) error {
+	for i := 0; i < MAX_POOL_UPDATE_ATTEMPTS; i++ {
+		if err := sc.LoadPool(ctx); err != nil {
+			return err
+		}
+
+		pool := sc.Pool().clone()
+		oldBlocks := blockCount(pool.Size())
+		runs, err := change(pool)
+		if err != nil {
+			return err
+		}
+
+		if err := pool.Validate(); err != nil {
+			return err
+		}
+
+		def, err := json.Marshal(pool)
+		if err != nil {
+			return fmt.Errorf("Error encoding pool definition: %s", err)
+		}
+
+		args := []interface{}{def, blockCount(pool.Size()), oldBlocks}
+		for _, run := range runs {
+			args = append(args, run.first, run.last, run.bit)
+		}
+		args = append(args, pool.Version)
+
+		version, err := poolUpdateScript.Run(ctx, sc.client,
+			append(rangeKeys(sc.ks), sc.ks.Key(POOL_DEFINITION), sc.ks.Key(POOL_VERSION)), args...).Int64()
+		if _, ok := scriptError(err, "STALEPOOL"); ok {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("Error updating pool definition: %s", err)
+		}
+
+		pool.Version = version
+		sc.pool.Store(pool)
+		return nil
+	}
+
+	return newKindError(ErrContention, "Error max pool update attempts exceeded (%d)", MAX_POOL_UPDATE_ATTEMPTS)
+}
+
+// returns the run of positions of a range, which must lie into a single range of the pool
+func (p *Pool) rangeRun(r IPRange, bit int) (bitRun, error) {
+	first, okStart := p.Index(r.Start)
+	last, okEnd := p.Index(r.End)
+	if !okStart || !okEnd || last-first+1 != r.Size() {
+		return bitRun{}, fmt.Errorf("Error range %s is not part of a pool range", r)
+	}
+	return bitRun{first: first, last: last, bit: bit}, nil
+}
+
+/*
+Appends the range to the pool and returns the bit updates making it available.
+Positions beyond the last block of the old range belong to blocks never
+created, so only the old padding bits need to be cleared.
+*/
+func (p *Pool) grow(r IPRange) ([]bitRun, error) {
+	oldSize := p.Size()
+	p.Ranges = append(p.Ranges, r)
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	newSize := p.Size()
+
+	oldEnd := uint32(uint64(blockCount(oldSize))*RANGE_BLOCK_BITS - 1)
+	newEnd := uint32(uint64(blockCount(newSize))*RANGE_BLOCK_BITS - 1)
+
+	var runs []bitRun
+	if oldSize <= oldEnd {
+		last := oldEnd
+		if newSize-1 < last {
+			last = newSize - 1
+		}
+		runs = append(runs, bitRun{first: oldSize, last: last, bit: 0})
+	}
+
+	for _, excl := range p.Exclusions {
+		if r.Contains(excl.Start) {
+			run, err := p.rangeRun(excl, 1)
+			if err != nil {
+				return nil, err
+			}
+			runs = append(runs, run)
+		}
+	}
+
+	// padding bits of the new last block
+	if newEnd > oldEnd && newEnd >= newSize {
+		first := newSize
+		if first <= oldEnd {
+			first = oldEnd + 1
+		}
+		runs = append(runs, bitRun{first: first, last: newEnd, bit: 1})
+	}
+
+	return runs, nil
+}
+
+// marks the range as draining and returns the bit updates preventing new leases on it
+func (p *Pool) drain(r IPRange, deadline time.Time) ([]bitRun, error) {
+	run, err := p.rangeRun(r, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, d := range p.Draining {
+		if d.Range.Contains(r.Start) || r.Contains(d.Range.Start) {
+			return nil, fmt.Errorf("Error range %s overlaps draining range %s", r, d.Range)
+		}
+	}
+
+	p.Draining = append(p.Draining, Drain{Range: r, Deadline: deadline})
+	return []bitRun{run}, nil
+}
+
+/*
+Removes a drained range from the pool, no bit update is needed as the bits of
+a draining range are all set. A range at the end of the pool is cut from it,
+along with its exclusions; anywhere else dropping it would shift the positions
+of the addresses following it, so it is kept as an exclusion.
+*/
+func (p *Pool) finalize(r IPRange) error {
+	found := false
+	for i, d := range p.Draining {
+		if d.Range.String() == r.String() {
+			p.Draining = append(p.Draining[:i], p.Draining[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("Error range %s is not draining", r)
+	}
+
+	last := &p.Ranges[len(p.Ranges)-1]
+	if !last.End.Equal(r.End) || (last.Start.Equal(r.Start) && len(p.Ranges) == 1) {
+		p.Exclusions = append(p.Exclusions, r)
+		return nil
+	}
+
+	if last.Start.Equal(r.Start) {
+		p.Ranges = p.Ranges[:len(p.Ranges)-1]
+	} else {
+		last.End = dhcp4.IPAdd(r.Start, -1)
+	}
+
+	exclusions := p.Exclusions[:0]
+	for _, excl := range p.Exclusions {
+		if r.Contains(excl.Start) {
+			continue
+		}
+		if r.Contains(excl.End) {
+			excl.End = dhcp4.IPAdd(r.Start, -1)
+		}
+		exclusions = append(exclusions, excl)
+	}
+	p.Exclusions = exclusions
+
+	return nil
+}
+
+/*
+Adds a range to the pool while preserving the existing bindings.
+*/
+func (sc *SharedContext) GrowPool(ctx context.Context, r IPRange) error {
+	return sc.updatePool(ctx, func(pool *Pool) ([]bitRun, error) {
+		return pool.grow(r)
+	})
+}
+
+/*
+Removes a range from the pool while preserving the existing bindings: no new
+lease is made on the range, renewals are shortened to the deadline and
+refused after it. The range stays into the allocation index space, so the
+positions of the other addresses don't change, until FinalizeDrains removes it.
+*/
+func (sc *SharedContext) ShrinkPool(ctx context.Context, r IPRange, deadline time.Time) error {
+	if deadline.IsZero() {
+		return fmt.Errorf("Error shrinking range %s requires a deadline", r)
+	}
+
+	return sc.updatePool(ctx, func(pool *Pool) ([]bitRun, error) {
+		return pool.drain(r, deadline)
+	})
+}
+
+/*
+Moves the clients of a range to a new one: the new range is added to the
+pool, the old one is drained and its clients get a NAK at their next renewal,
+so they obtain an address of the new range one at a time.
+*/
+func (sc *SharedContext) RenumberPool(ctx context.Context, from, to IPRange) error {
+	return sc.updatePool(ctx, func(pool *Pool) ([]bitRun, error) {
+		growRuns, err := pool.grow(to)
+		if err != nil {
+			return nil, err
+		}
+
+		drainRuns, err := pool.drain(from, time.Time{})
+		if err != nil {
+			return nil, err
+		}
+
+		return append(growRuns, drainRuns...), nil
+	})
+}
+
+/*
+Removes from the pool the drained ranges past their deadline, or without one,
+that have no lease left. Returns the ranges removed.
+*/
+func (sc *SharedContext) FinalizeDrains(ctx context.Context) ([]IPRange, error) {
+	if err := sc.LoadPool(ctx); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var due []IPRange
+	for _, d := range sc.Pool().Draining {
+		if d.Deadline.IsZero() || now.After(d.Deadline) {
+			due = append(due, d.Range)
+		}
+	}
+	if len(due) == 0 {
+		return nil, nil
+	}
+
+	// no lease is made or renewed on a range past its deadline, so the ranges
+	// found empty stay empty
+	leased := make(map[string]bool)
+	err := sc.ForEachMapping(ctx, func(l *Lease) error {
+		for _, r := range due {
+			if r.Contains(l.IP) {
+				leased[r.String()] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var finalized []IPRange
+	for _, r := range due {
+		if leased[r.String()] {
+			continue
+		}
+		err := sc.updatePool(ctx, func(pool *Pool) ([]bitRun, error) {
+			return nil, pool.finalize(r)
+		})
+		if err != nil {
+			return finalized, err
+		}
+		finalized = append(finalized, r)
+	}
+
+	return finalized, nil
+}
+
+/*
+Returns the remaining lease time for a renewal of an address: the requested
+lease time if the address is not draining, the time left to the drain
+deadline otherwise. A zero result means that the renewal must be refused.
+*/
+func (p *Pool) RenewalTime(ip net.IP, leaseTime time.Duration) time.Duration {
+	drain := p.DrainOf(ip)
+	if drain == nil {
+		return leaseTime
+	}
+
+	if drain.Deadline.IsZero() {
+		return 0
+	}
+
+	left := time.Until(drain.Deadline)
+	if left <= 0 {
+		return 0
+	}
+	if left < leaseTime {
+		return left
+	}
+	return leaseTime
+}
@@ -0,0 +1,253 @@
+package dhcpdb
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPoolGrow(t *testing.T) {
+	mask := net.IPv4Mask(255, 255, 0, 0)
+	rng := func(str string) IPRange {
+		r, err := ParseIPRange(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	tests := []struct {
+		name       string
+		ranges     []string
+		exclusions []string
+		grow       string
+		want       []bitRun
+		wantErr    bool
+	}{
+		{
+			name:   "padding of the last block cleared",
+			ranges: []string{"10.0.0.10-10.0.0.19"},
+			grow:   "10.0.0.100-10.0.0.109",
+			want:   []bitRun{{first: 10, last: 19, bit: 0}},
+		},
+		{
+			name:       "exclusion of the new range set",
+			ranges:     []string{"10.0.0.10-10.0.0.19"},
+			exclusions: []string{"10.0.0.12", "10.0.0.105-10.0.0.106"},
+			grow:       "10.0.0.100-10.0.0.109",
+			want:       []bitRun{{first: 10, last: 19, bit: 0}, {first: 15, last: 16, bit: 1}},
+		},
+		{
+			name:   "new block padded",
+			ranges: []string{"10.0.0.1-10.0.31.254"}, // 8190 addresses
+			grow:   "10.0.32.1-10.0.32.10",
+			want:   []bitRun{{first: 8190, last: 8191, bit: 0}, {first: 8200, last: 16383, bit: 1}},
+		},
+		{
+			name:   "full last block",
+			ranges: []string{"10.0.0.1-10.0.32.0"}, // 8192 addresses
+			grow:   "10.0.33.1-10.0.33.10",
+			want:   []bitRun{{first: 8202, last: 16383, bit: 1}},
+		},
+		{
+			name:    "overlapping range",
+			ranges:  []string{"10.0.0.10-10.0.0.19"},
+			grow:    "10.0.0.15-10.0.0.25",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := &Pool{Mask: mask}
+			for _, r := range tt.ranges {
+				pool.Ranges = append(pool.Ranges, rng(r))
+			}
+			for _, excl := range tt.exclusions {
+				pool.Exclusions = append(pool.Exclusions, rng(excl))
+			}
+
+			runs, err := pool.grow(rng(tt.grow))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("grow(%s) = %v, want error", tt.grow, runs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("grow(%s) error: %s", tt.grow, err)
+			}
+			if !reflect.DeepEqual(runs, tt.want) {
+				t.Errorf("grow(%s) = %v, want %v", tt.grow, runs, tt.want)
+			}
+		})
+	}
+}
+
+func TestPoolFinalize(t *testing.T) {
+	mask := net.IPv4Mask(255, 255, 255, 0)
+	rng := func(str string) IPRange {
+		r, err := ParseIPRange(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	strs := func(ranges []IPRange) []string {
+		var res []string
+		for _, r := range ranges {
+			res = append(res, r.String())
+		}
+		return res
+	}
+
+	tests := []struct {
+		name           string
+		ranges         []string
+		exclusions     []string
+		drain          string
+		wantRanges     []string
+		wantExclusions []string
+		wantErr        bool
+	}{
+		{
+			name:       "last range dropped",
+			ranges:     []string{"10.0.0.10-10.0.0.19", "10.0.0.100-10.0.0.109"},
+			exclusions: []string{"10.0.0.12", "10.0.0.105"},
+			drain:      "10.0.0.100-10.0.0.109",
+			wantRanges: []string{"10.0.0.10-10.0.0.19"}, wantExclusions: []string{"10.0.0.12-10.0.0.12"},
+		},
+		{
+			name:       "end of the last range cut",
+			ranges:     []string{"10.0.0.10-10.0.0.19"},
+			exclusions: []string{"10.0.0.14-10.0.0.16"},
+			drain:      "10.0.0.15-10.0.0.19",
+			wantRanges: []string{"10.0.0.10-10.0.0.14"}, wantExclusions: []string{"10.0.0.14-10.0.0.14"},
+		},
+		{
+			name:       "first range excluded",
+			ranges:     []string{"10.0.0.10-10.0.0.19", "10.0.0.100-10.0.0.109"},
+			drain:      "10.0.0.10-10.0.0.19",
+			wantRanges: []string{"10.0.0.10-10.0.0.19", "10.0.0.100-10.0.0.109"}, wantExclusions: []string{"10.0.0.10-10.0.0.19"},
+		},
+		{
+			name:       "only range excluded",
+			ranges:     []string{"10.0.0.10-10.0.0.19"},
+			drain:      "10.0.0.10-10.0.0.19",
+			wantRanges: []string{"10.0.0.10-10.0.0.19"}, wantExclusions: []string{"10.0.0.10-10.0.0.19"},
+		},
+		{
+			name:    "range not draining",
+			ranges:  []string{"10.0.0.10-10.0.0.19"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := &Pool{Mask: mask}
+			for _, r := range tt.ranges {
+				pool.Ranges = append(pool.Ranges, rng(r))
+			}
+			for _, excl := range tt.exclusions {
+				pool.Exclusions = append(pool.Exclusions, rng(excl))
+			}
+			if tt.drain != "" {
+				if _, err := pool.drain(rng(tt.drain), time.Now()); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			r := rng("10.0.0.15-10.0.0.19")
+			if tt.drain != "" {
+				r = rng(tt.drain)
+			}
+			err := pool.finalize(r)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("finalize(%s) succeeded, want error", r)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("finalize(%s) error: %s", r, err)
+			}
+			if len(pool.Draining) != 0 {
+				t.Errorf("draining %v after finalize, want none", pool.Draining)
+			}
+			if got := strs(pool.Ranges); !reflect.DeepEqual(got, tt.wantRanges) {
+				t.Errorf("ranges %v, want %v", got, tt.wantRanges)
+			}
+			if got := strs(pool.Exclusions); !reflect.DeepEqual(got, tt.wantExclusions) {
+				t.Errorf("exclusions %v, want %v", got, tt.wantExclusions)
+			}
+			if err := pool.Validate(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestFinalizeDrains(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestClient(t)
+	ks := NewKeyspace("test")
+
+	// the drained range is the only one of the second block
+	pool, err := NewPool([]string{"10.0.0.1-10.0.31.254", "10.0.40.1-10.0.40.10"}, nil, net.IPv4Mask(255, 255, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := InitPool(ctx, client, ks, pool, false); err != nil {
+		t.Fatal(err)
+	}
+	sc := NewSharedContext(client, ks, pool)
+	if err := sc.LoadPool(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	ipAddr := net.IPv4(10, 0, 40, 5).To4()
+	hwAddr := net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}
+	if err := sc.AddIPMACMapping(ctx, &ipAddr, &hwAddr, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	drained, _ := ParseIPRange("10.0.40.1-10.0.40.10")
+	if err := sc.ShrinkPool(ctx, drained, time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	if finalized, err := sc.FinalizeDrains(ctx); err != nil || len(finalized) != 0 {
+		t.Fatalf("FinalizeDrains() = %v, %v with a lease left, want none", finalized, err)
+	}
+
+	if err := sc.RemoveIPMapping(ctx, &ipAddr, &hwAddr); err != nil {
+		t.Fatal(err)
+	}
+	finalized, err := sc.FinalizeDrains(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(finalized) != 1 || finalized[0].String() != drained.String() {
+		t.Fatalf("FinalizeDrains() = %v, want %s", finalized, drained)
+	}
+
+	if ranges := sc.Pool().Ranges; len(ranges) != 1 || len(sc.Pool().Draining) != 0 {
+		t.Errorf("pool ranges %v draining %v, want the first range only", ranges, sc.Pool().Draining)
+	}
+	if used, size, err := sc.Usage(ctx); err != nil || used != 0 || size != 8190 {
+		t.Errorf("Usage() = %d, %d, %v, want 0, 8190", used, size, err)
+	}
+	if n, err := client.Exists(ctx, blockKey(ks, 1)).Result(); err != nil || n != 0 {
+		t.Errorf("block 1 still stored after finalize")
+	}
+	report, err := sc.Fsck(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Clean() {
+		t.Errorf("Fsck() found %+v after finalize, want clean", report)
+	}
+}
@@ -0,0 +1,237 @@
+package dhcpdb
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+/*
+Lua scripts executing the SharedContext mutations atomically on the Redis
+server in a single round trip. They are run through EVALSHA, falling back to
+EVAL when the script is not cached on the server yet.
+
+Common keys:  KEYS[1] leasing range base key (blocks are <base>:<n>),
+KEYS[2] free blocks sorted set, KEYS[3] used bits counter, KEYS[4] range
+watermark. Mapping scripts add KEYS[5] ip-mac mapping sorted set (scored by
+expiry time), KEYS[6] ip:<address> key, KEYS[7] address owners hash and
+KEYS[8] offers sorted set.
+Common args:  ARGV[1] position into the leasing range, ARGV[2] hardware
+address, ARGV[3] mapping set member, ARGV[4] address.
+
+The last key and argument of every script are the pool version key and the
+version of the pool known by the caller: positions are computed from the pool
+definition, so the scripts refuse to run with a stale one.
+*/
+
+const poolVersionCheck = `
+if (redis.call('GET', KEYS[#KEYS]) or '0') ~= ARGV[#ARGV] then
+	return redis.error_reply('STALEPOOL')
+end
+`
+
+// sets a bit of the leasing range keeping the block summaries up to date,
+// returns the previous value of the bit
+var rangeBlockFunctions = `
+local blockBits = ` + strconv.Itoa(RANGE_BLOCK_BITS) + `
+local function setPos(pos, bit)
+	pos = tonumber(pos)
+	local block = math.floor(pos / blockBits)
+	local old = redis.call('SETBIT', KEYS[1] .. ':' .. block, pos % blockBits, bit)
+	if old ~= bit then
+		redis.call('INCRBY', KEYS[3], bit == 1 and 1 or -1)
+	end
+	if bit == 0 then
+		redis.call('ZADD', KEYS[2], block, block)
+	end
+	return old
+end
+`
+
+// allocates a free bit of a leasing range of the given number of blocks and
+// size, returns its position or -1 if the range is exhausted. Blocks with free
+// bits are taken from the free blocks set, lowest first, full ones being
+// dropped from it lazily; when the set is empty the block at the watermark,
+// never used before, is added to it. Cost does not depend on the size of the
+// range and exhaustion is detected from the used bits counter.
+var rangeAllocFunction = `
+local function allocPos(blocks, size)
+	if tonumber(redis.call('GET', KEYS[3]) or '0') >= blocks * blockBits then
+		return -1
+	end
+	while true do
+		local block = redis.call('ZRANGE', KEYS[2], 0, 0)[1]
+		if not block then
+			block = tonumber(redis.call('GET', KEYS[4]) or '0')
+			if block >= blocks then
+				return -1
+			end
+			redis.call('INCR', KEYS[4])
+			redis.call('ZADD', KEYS[2], block, block)
+		end
+		block = tonumber(block)
+		local pos = block * blockBits + redis.call('BITPOS', KEYS[1] .. ':' .. block, 0)
+		if pos < (block + 1) * blockBits and pos < size then
+			setPos(pos, 1)
+			return pos
+		end
+		redis.call('ZREM', KEYS[2], block)
+	end
+end
+`
+
+/*
+Allocates an address to offer. KEYS[5] offers sorted set (positions scored by
+offer deadline in milliseconds). ARGV[1] number of blocks of the leasing
+range, ARGV[2] size of the leasing range, ARGV[3] offer deadline. The bit is
+set, so concurrent allocations don't return the same address, until the
+address is bound or the offer expires (see ExpireOffers).
+*/
+var allocateScript = redis.NewScript(poolVersionCheck + rangeBlockFunctions + rangeAllocFunction + `
+local pos = allocPos(tonumber(ARGV[1]), tonumber(ARGV[2]))
+if pos ~= -1 then
+	redis.call('ZADD', KEYS[5], ARGV[3], pos)
+end
+return pos
+`)
+
+// ARGV[5] mapping score, ARGV[6] lease time in milliseconds (0 for no expiry)
+var bindScript = redis.NewScript(poolVersionCheck + rangeBlockFunctions + `
+local cur = redis.call('GET', KEYS[6])
+if cur and cur ~= ARGV[2] then
+	return redis.error_reply('CONFLICT ' .. cur)
+end
+local prev = redis.call('HGET', KEYS[7], ARGV[4])
+if prev and prev ~= ARGV[2] then
+	redis.call('ZREM', KEYS[5], ARGV[4] .. '-' .. prev)
+end
+setPos(ARGV[1], 1)
+redis.call('ZREM', KEYS[8], ARGV[1])
+redis.call('ZADD', KEYS[5], ARGV[5], ARGV[3])
+redis.call('HSET', KEYS[7], ARGV[4], ARGV[2])
+if tonumber(ARGV[6]) > 0 then
+	redis.call('SET', KEYS[6], ARGV[2], 'PX', ARGV[6])
+else
+	redis.call('SET', KEYS[6], ARGV[2])
+end
+return 1
+`)
+
+// ARGV[5] mapping score, ARGV[6] lease time in milliseconds (0 for no expiry)
+var renewScript = redis.NewScript(poolVersionCheck + `
+local cur = redis.call('GET', KEYS[6])
+if cur ~= ARGV[2] then
+	return redis.error_reply('NOTBOUND')
+end
+redis.call('ZADD', KEYS[5], ARGV[5], ARGV[3])
+if tonumber(ARGV[6]) > 0 then
+	redis.call('SET', KEYS[6], ARGV[2], 'PX', ARGV[6])
+else
+	redis.call('SET', KEYS[6], ARGV[2])
+end
+return 1
+`)
+
+// ARGV[5] 1 if the bit must stay set (draining address). Returns 1 if the
+// mapping has been removed, 0 if the address was not bound to the hardware address
+var releaseScript = redis.NewScript(poolVersionCheck + rangeBlockFunctions + `
+local cur = redis.call('GET', KEYS[6])
+if cur and cur ~= ARGV[2] then
+	return 0
+end
+redis.call('DEL', KEYS[6])
+local removed = redis.call('ZREM', KEYS[5], ARGV[3])
+if redis.call('HGET', KEYS[7], ARGV[4]) == ARGV[2] then
+	removed = removed + redis.call('HDEL', KEYS[7], ARGV[4])
+end
+if removed == 0 and not cur then
+	return 0
+end
+if ARGV[5] ~= '1' then
+	setPos(ARGV[1], 0)
+end
+return 1
+`)
+
+/*
+Frees an address whose ip:<address> key timed out. ARGV[2] is the hardware
+address found into the mapping set, empty if unknown, ARGV[5] 1 if the bit must
+stay set (draining address). Returns the hardware address the lease belonged
+to, nil if the address has been bound again or already reaped: the owner entry
+is removed atomically, so only one of the replicas racing on the same expiry
+frees the address.
+*/
+var reapScript = redis.NewScript(poolVersionCheck + rangeBlockFunctions + `
+if redis.call('EXISTS', KEYS[6]) == 1 then
+	return false
+end
+local mac = redis.call('HGET', KEYS[7], ARGV[4]) or ARGV[2]
+if mac == '' then
+	return false
+end
+local removed = redis.call('HDEL', KEYS[7], ARGV[4]) + redis.call('ZREM', KEYS[5], ARGV[4] .. '-' .. mac)
+if removed == 0 then
+	return false
+end
+if ARGV[5] ~= '1' then
+	setPos(ARGV[1], 0)
+end
+return mac
+`)
+
+/*
+Frees the addresses offered and not bound in time. KEYS[5] offers sorted set,
+KEYS[6] address owners hash. ARGV[1] current time in milliseconds, ARGV[2..]
+position, address and keep flag of each offer. Offers made again in the
+meanwhile are skipped, the bit of an address is cleared unless it is bound or
+the keep flag is 1 (excluded or draining address). Returns the number of
+addresses freed.
+*/
+var expireOffersScript = redis.NewScript(poolVersionCheck + rangeBlockFunctions + `
+local freed = 0
+for i = 2, #ARGV - 1, 3 do
+	local deadline = redis.call('ZSCORE', KEYS[5], ARGV[i])
+	if deadline and tonumber(deadline) <= tonumber(ARGV[1]) then
+		redis.call('ZREM', KEYS[5], ARGV[i])
+		if ARGV[i + 2] ~= '1' and redis.call('HEXISTS', KEYS[6], ARGV[i + 1]) == 0 then
+			setPos(ARGV[i], 0)
+			freed = freed + 1
+		end
+	end
+end
+return freed
+`)
+
+var sharedContextScripts = []*redis.Script{allocateScript, bindScript, renewScript, releaseScript, reapScript,
+	expireOffersScript, claimScript, unclaimScript}
+
+/*
+Loads the scripts into the Redis script cache, so that the first calls don't
+need to send the whole script body.
+*/
+func LoadScripts(ctx context.Context, client redis.UniversalClient) error {
+	for _, script := range sharedContextScripts {
+		if err := script.Load(ctx, client).Err(); err != nil {
+			return fmt.Errorf("Error loading script into Redis: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// returns the message of an error reply generated by a script, prefix excluded.
+// Some servers add the generic ERR code in front of the script error code.
+func scriptError(err error, prefix string) (string, bool) {
+	rErr, ok := err.(redis.Error)
+	if !ok {
+		return "", false
+	}
+	msg := strings.TrimPrefix(rErr.Error(), "ERR ")
+	if !strings.HasPrefix(msg, prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(strings.TrimPrefix(msg, prefix)), true
+}
@@ -2,15 +2,14 @@ package dhcpdb
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
-	"log"
 	"net"
 	"strconv"
-	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/krolaw/dhcp4"
-
 	"github.com/go-redis/redis/v8"
 )
 
@@ -18,30 +17,44 @@ const (
 	SECONDS_IN_HOUR      = 3600
 	LEASING_RANGE_BITSET = "leasingRange"
 	IP_MAC_MAPPING_SET   = "ipMacMapping"
+	IP_OWNERS_HASH       = "ipOwners"
+	ADDRESS_OFFERS_SET   = "addressOffers"
+	OFFER_TTL            = time.Minute
 )
 
 type SharedContext struct {
-	client             *redis.Client
-	maxLeaseRange      uint32
-	rangeStartIp       *net.IP
-	maxTxRetryAttempts uint8
+	client    redis.UniversalClient
+	ks        Keyspace
+	pool      atomic.Value // *Pool, replaced as a whole at every change
+	replicaID string
 }
 
-func NewRedisClient(hostname string, port uint16) *redis.Client {
-	return redis.NewClient(&redis.Options{
-		Addr:     hostname + ":" + strconv.Itoa(int(port)),
-		Password: "",
-		DB:       0,
-	})
-}
+func NewSharedContext(client redis.UniversalClient, ks Keyspace, pool *Pool) *SharedContext {
+	id := make([]byte, 8)
+	rand.Read(id)
 
-func NewSharedContext(client *redis.Client, maxLeaseRange uint32, startIP *net.IP, maxTxRetryAttempts uint8) *SharedContext {
-	return &SharedContext{
-		client:             client,
-		maxLeaseRange:      maxLeaseRange,
-		rangeStartIp:       startIP,
-		maxTxRetryAttempts: maxTxRetryAttempts,
+	sc := &SharedContext{
+		client:    client,
+		ks:        ks,
+		replicaID: hex.EncodeToString(id),
 	}
+	sc.pool.Store(pool)
+	return sc
+}
+
+/*
+Returns the identifier of the replica, used as origin of the lease events it
+publishes.
+*/
+func (sc *SharedContext) ReplicaID() string {
+	return sc.replicaID
+}
+
+// publishes a change of binding made by this replica. Best effort: the
+// entries cached by the other replicas expire anyway
+func (sc *SharedContext) publishChange(ctx context.Context, eventType string, ipAddr *net.IP, hwAddr *net.HardwareAddr) {
+	event := &LeaseEvent{Type: eventType, IP: ipAddr.String(), MAC: hwAddr.String(), Time: time.Now(), Origin: sc.replicaID}
+	sc.publishEvent(ctx, event)
 }
 
 func getLastRangeByte(maxLeaseRange uint32) uint32 {
@@ -57,300 +70,273 @@ func (sc *SharedContext) Close() error {
 	return sc.client.Close()
 }
 
-func (sc *SharedContext) GetFirstAvailableAddress() (*net.IP, error) {
-	ctx := context.Background()
-
-	var pos int64
-	var err error
-
-	for i := uint8(0); i < sc.maxTxRetryAttempts; i++ {
-		res := sc.client.Watch(ctx, func(tx *redis.Tx) error {
-
-			pos, err = tx.BitPos(ctx, LEASING_RANGE_BITSET, 0, 0).Result()
+// returns the position of the address into the leasing range bitset
+func (p *Pool) rangePos(ipAddr *net.IP) (int64, error) {
+	pos, ok := p.Index(*ipAddr)
+	if !ok {
+		return 0, fmt.Errorf("Error address %s out of leasing range", ipAddr)
+	}
+	return int64(pos), nil
+}
 
-			if err != nil && err != redis.Nil {
-				return err
-			}
+func (sc *SharedContext) mappingKeys(ipAddr *net.IP) []string {
+	return append(rangeKeys(sc.ks), sc.ks.Key(IP_MAC_MAPPING_SET), sc.ks.ipKey(ipAddr.String()),
+		sc.ks.Key(IP_OWNERS_HASH), sc.ks.Key(ADDRESS_OFFERS_SET), sc.ks.Key(POOL_VERSION))
+}
 
-			if err == redis.Nil {
-				return fmt.Errorf("Error Bitset %s not defined into remote database", LEASING_RANGE_BITSET)
-			}
+// returns "1" if the bit of the address must stay set once released: excluded
+// addresses, such as the local blocks of the replicas, and draining ones
+func (p *Pool) keepBit(ipAddr *net.IP) string {
+	if p.Excluded(*ipAddr) || p.DrainOf(*ipAddr) != nil {
+		return "1"
+	}
+	return "0"
+}
 
-			return nil
-		}, LEASING_RANGE_BITSET)
-
-		if res == nil && pos != -1 {
-			addr := dhcp4.IPAdd(*sc.rangeStartIp, int(pos))
-			return &addr, nil
-		} else if res == nil {
-			return nil, fmt.Errorf("Error no more ip addresses available")
-		} else if res == redis.TxFailedErr {
-			continue
-		} else {
-			return nil, res
+/*
+Runs op, a script execution depending on the pool definition. If another
+replica changed the pool in the meanwhile, the definition is reloaded and op
+is run again.
+*/
+func (sc *SharedContext) withFreshPool(ctx context.Context, op func() error) error {
+	err := op()
+	if _, ok := scriptError(err, "STALEPOOL"); ok {
+		if err := sc.LoadPool(ctx); err != nil {
+			return err
 		}
+		err = op()
 	}
-
-	return nil, fmt.Errorf("Error max retry transaction attempts exceeded (%d)", sc.maxTxRetryAttempts)
+	return err
 }
 
-func (sc *SharedContext) GetPortMACMapping(ipAddr *net.IP) (*net.HardwareAddr, error) {
-	ctx := context.Background()
+func mappingMember(ipAddr *net.IP, hwAddr *net.HardwareAddr) string {
+	return fmt.Sprintf("%s-%s", ipAddr, hwAddr)
+}
 
-	res, err := sc.client.Get(ctx, "ip:"+ipAddr.String()).Result()
-	if err != nil {
-		return nil, err
-	} else {
-		hwAddr, err := net.ParseMAC(res)
-		return &hwAddr, err
+// returns the mapping set score of a lease, its expiry time
+func mappingScore(leaseTime time.Duration) string {
+	if leaseTime <= 0 {
+		return "+inf"
 	}
+	return strconv.FormatInt(time.Now().Add(leaseTime).UnixNano(), 10)
 }
 
-func (sc *SharedContext) AddIPMACMapping(ipAddr *net.IP, hwAddr *net.HardwareAddr, leaseTime time.Duration) error {
-	ctx := context.Background()
-
-	val := fmt.Sprintf("%s-%s", ipAddr, hwAddr)
+/*
+Returns a free address to offer. The address is held for OFFER_TTL, so the
+other replicas don't offer it in the meanwhile, and freed by ExpireOffers if
+the client does not request it in time.
+*/
+func (sc *SharedContext) GetFirstAvailableAddress(ctx context.Context) (*net.IP, error) {
+	keys := append(rangeKeys(sc.ks), sc.ks.Key(ADDRESS_OFFERS_SET), sc.ks.Key(POOL_VERSION))
+	deadline := time.Now().Add(OFFER_TTL).UnixNano() / int64(time.Millisecond)
 
-	score := time.Now().UnixNano()
-
-	for i := uint8(0); i < sc.maxTxRetryAttempts; i++ {
-		res := sc.client.Watch(ctx, func(tx *redis.Tx) error {
-			pos, err := tx.BitPos(ctx, LEASING_RANGE_BITSET, 0, 0).Result()
-
-			if err != nil && err != redis.Nil {
-				return err
-			}
-
-			if err == redis.Nil {
-				return fmt.Errorf("Error Bitset %s not defined into remote database", LEASING_RANGE_BITSET)
-			}
-
-			_, err = tx.SetBit(ctx, LEASING_RANGE_BITSET, pos, 1).Result()
-			if err != nil && err != redis.Nil {
-				return err
-			}
-
-			if err == redis.Nil {
-				return fmt.Errorf("Error Bitset %s not defined into remote database", LEASING_RANGE_BITSET)
-			}
-
-			err = tx.ZAdd(ctx, IP_MAC_MAPPING_SET, &redis.Z{Score: float64(score), Member: val}).Err()
-			if err != nil {
-				return err
-			}
+	var pos int64
+	var pool *Pool
+	err := sc.withFreshPool(ctx, func() (err error) {
+		pool = sc.Pool()
+		pos, err = allocateScript.Run(ctx, sc.client, keys, blockCount(pool.Size()), pool.Size(), deadline,
+			pool.Version).Int64()
+		return err
+	})
+	if err != nil {
+		return nil, unavailable(err)
+	}
 
-			_, err = tx.Set(ctx, "ip:"+ipAddr.String(), hwAddr.String(), leaseTime).Result()
-			return err
-		}, "ip:"+ipAddr.String(), IP_MAC_MAPPING_SET, LEASING_RANGE_BITSET)
-
-		if res == nil {
-			return nil
-		} else if res == redis.TxFailedErr {
-			continue
-		} else {
-			return res
-		}
+	if pos == -1 {
+		return nil, ErrPoolExhausted
 	}
 
-	return fmt.Errorf("Error max retry transaction attempts exceeded (%d)", sc.maxTxRetryAttempts)
+	addr := pool.IPAt(uint32(pos))
+	return &addr, nil
 }
 
-func (sc *SharedContext) RemoveIPMapping(ipAddr *net.IP, hwAddr *net.HardwareAddr) error {
-	ctx := context.Background()
-
-	for i := uint8(0); i < sc.maxTxRetryAttempts; i++ {
-		err := sc.client.Watch(ctx, func(tx *redis.Tx) error {
-			_, err := tx.SetBit(ctx, LEASING_RANGE_BITSET, int64(dhcp4.IPRange(*sc.rangeStartIp, *ipAddr)-1),
-				0).Result()
-			if err == redis.Nil {
-				return fmt.Errorf("Error no address mapping defined on db")
-			}
-
-			res, err := tx.Get(ctx, "ip:"+ipAddr.String()).Result()
-			if err == redis.Nil {
-				// nothing to remove, maybe someone provided an address not leased or
-				// the timeout did the work for us
-				return nil
-			} else if err != nil {
-				return err
-			}
+/*
+Frees the addresses offered to clients that did not request them before the
+offer deadline. Returns the number of addresses freed.
+*/
+func (sc *SharedContext) ExpireOffers(ctx context.Context) (int, error) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	members, err := sc.client.ZRangeByScore(ctx, sc.ks.Key(ADDRESS_OFFERS_SET), &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now, 10),
+	}).Result()
+	if err != nil {
+		return 0, fmt.Errorf("Error reading %s: %s", ADDRESS_OFFERS_SET, err)
+	}
+	if len(members) == 0 {
+		return 0, nil
+	}
 
-			// check if the stored hw address is equal with the one of the incoming request
-			if res != hwAddr.String() {
-				// and if they are different, the ip has been leased one more time to
-				// someone else
-				return nil
-			}
+	keys := append(rangeKeys(sc.ks), sc.ks.Key(ADDRESS_OFFERS_SET), sc.ks.Key(IP_OWNERS_HASH), sc.ks.Key(POOL_VERSION))
 
-			_, err = tx.Del(ctx, "ip:"+ipAddr.String()).Result()
+	var freed int
+	err = sc.withFreshPool(ctx, func() (err error) {
+		pool := sc.Pool()
+		args := []interface{}{now}
+		for _, member := range members {
+			pos, err := strconv.ParseUint(member, 10, 32)
 			if err != nil {
-				return err
+				continue
 			}
-
-			_, err = tx.ZRem(ctx, IP_MAC_MAPPING_SET, ipAddr.String()).Result()
-			if err != nil && err != redis.Nil {
-				return err
-			} else if err == redis.Nil {
-				// nothing to do, some one else removed the mapping for us
-				return nil
+			ip := pool.IPAt(uint32(pos))
+			keep := "0"
+			if ip == nil || !pool.Leasable(ip) {
+				keep = "1"
 			}
-
-			return err
-		}, "ip:"+ipAddr.String(), LEASING_RANGE_BITSET, IP_MAC_MAPPING_SET)
-
-		if err == redis.TxFailedErr {
-			continue
-		} else {
-			return err
+			args = append(args, member, ip.String(), keep)
 		}
+		args = append(args, pool.Version)
+
+		freed, err = expireOffersScript.Run(ctx, sc.client, keys, args...).Int()
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Error expiring address offers: %s", err)
 	}
 
-	return fmt.Errorf("Error max retry transaction attempts exceeded (%d)", sc.maxTxRetryAttempts)
+	return freed, nil
 }
 
-func CleanUpAvailableIpRange(client *redis.Client) error {
-	ctx := context.Background()
-
-	_, err := client.Del(ctx, LEASING_RANGE_BITSET).Result()
-	if err != nil {
-		return fmt.Errorf("Error deleting Redis set %s: %s", LEASING_RANGE_BITSET, err)
+func (sc *SharedContext) GetPortMACMapping(ctx context.Context, ipAddr *net.IP) (*net.HardwareAddr, error) {
+	res, err := sc.client.Get(ctx, sc.ks.ipKey(ipAddr.String())).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, unavailable(err)
+	} else {
+		hwAddr, err := net.ParseMAC(res)
+		return &hwAddr, err
 	}
-
-	return nil
 }
 
-func CleanUpIpMacMapping(client *redis.Client) error {
-	ctx := context.Background()
+func (sc *SharedContext) AddIPMACMapping(ctx context.Context, ipAddr *net.IP, hwAddr *net.HardwareAddr, leaseTime time.Duration) error {
+	err := sc.withFreshPool(ctx, func() error {
+		pool := sc.Pool()
+		pos, err := pool.rangePos(ipAddr)
+		if err != nil {
+			return err
+		}
 
-	_, err := client.Del(ctx, IP_MAC_MAPPING_SET).Result()
-	if err != nil {
-		return fmt.Errorf("Error deleting Redis set %s: %s", IP_MAC_MAPPING_SET, err)
+		return bindScript.Run(ctx, sc.client, sc.mappingKeys(ipAddr), pos, hwAddr.String(), mappingMember(ipAddr, hwAddr),
+			ipAddr.String(), mappingScore(leaseTime), leaseTime.Milliseconds(), pool.Version).Err()
+	})
+	if owner, ok := scriptError(err, "CONFLICT"); ok {
+		return newKindError(ErrConflict, "Error address %s already leased to %s", ipAddr, owner)
+	} else if err != nil {
+		return unavailable(err)
 	}
 
+	sc.publishChange(ctx, LEASE_EVENT_BOUND, ipAddr, hwAddr)
 	return nil
 }
 
-func CleanUpIpSets(client *redis.Client) error {
-	ctx := context.Background()
-
-	sSlice, err := client.Keys(ctx, "ip:*").Result()
-	if err != nil {
-		return fmt.Errorf("Error obtaining keys from Redis: %s", err)
-	}
-
-	for _, keyStr := range sSlice {
-		_, err = client.Del(ctx, keyStr).Result()
+func (sc *SharedContext) RenewIPMACMapping(ctx context.Context, ipAddr *net.IP, hwAddr *net.HardwareAddr, leaseTime time.Duration) error {
+	err := sc.withFreshPool(ctx, func() error {
+		pool := sc.Pool()
+		pos, err := pool.rangePos(ipAddr)
 		if err != nil {
-			return fmt.Errorf("Error deleting key %s from Redis: %s", keyStr, err)
+			return err
 		}
+
+		return renewScript.Run(ctx, sc.client, sc.mappingKeys(ipAddr), pos, hwAddr.String(), mappingMember(ipAddr, hwAddr),
+			ipAddr.String(), mappingScore(leaseTime), leaseTime.Milliseconds(), pool.Version).Err()
+	})
+	if _, ok := scriptError(err, "NOTBOUND"); ok {
+		return newKindError(ErrNotFound, "Error address %s not leased to %s", ipAddr, hwAddr)
 	}
 
-	return nil
+	return unavailable(err)
 }
 
-func InitAvailableIpRange(client *redis.Client, leasesRange uint8) error {
-	ctx := context.Background()
-
-	var bitsetStr string = ""
-	for i := uint8(0); i < leasesRange; i++ {
-		bitsetStr += "\x00"
-	}
+func (sc *SharedContext) RemoveIPMapping(ctx context.Context, ipAddr *net.IP, hwAddr *net.HardwareAddr) error {
+	// nothing removed means that the address was not leased, the timeout did
+	// the work for us or the address has been leased to someone else
+	var removed int
+	err := sc.withFreshPool(ctx, func() (err error) {
+		pool := sc.Pool()
+		pos, err := pool.rangePos(ipAddr)
+		if err != nil {
+			return err
+		}
 
-	_, err := client.Set(ctx, LEASING_RANGE_BITSET, bitsetStr, 0).Result()
+		removed, err = releaseScript.Run(ctx, sc.client, sc.mappingKeys(ipAddr), pos, hwAddr.String(),
+			mappingMember(ipAddr, hwAddr), ipAddr.String(), pool.keepBit(ipAddr), pool.Version).Int()
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("Error during init of BitSet %s\n", LEASING_RANGE_BITSET)
+		return unavailable(err)
 	}
 
+	if removed == 1 {
+		sc.publishChange(ctx, LEASE_EVENT_RELEASED, ipAddr, hwAddr)
+	}
 	return nil
 }
 
-func (sc *SharedContext) CleanUpExpiredMappings(leaseTime, schedule time.Duration, logger *log.Logger) error {
-	ctx := context.Background()
-	ticker := time.NewTicker(schedule)
+func (sc *SharedContext) ForEachMapping(ctx context.Context, fn func(*Lease) error) error {
+	return forEachLease(ctx, sc.client, sc.ks, fn)
+}
 
-	for {
-		<-ticker.C
-		var sSlice []string
-		score := fmt.Sprintf("%d", time.Duration(time.Now().UnixNano())-leaseTime)
-		sSlice, err := sc.client.ZRangeByScore(ctx, IP_MAC_MAPPING_SET, &redis.ZRangeBy{Min: "-inf", Max: score}).Result()
-		if err != nil {
-			return fmt.Errorf("Error obtaining Redis set elements: %s", IP_MAC_MAPPING_SET)
+// calls fn for every lease of the keyspace, read from the ip:<address> keys
+func forEachLease(ctx context.Context, client redis.UniversalClient, ks Keyspace, fn func(*Lease) error) error {
+	return scanKeys(ctx, client, ks.ipKey("*"), func(keys []string) error {
+		pipe := client.Pipeline()
+		getCmds := make([]*redis.StringCmd, len(keys))
+		ttlCmds := make([]*redis.DurationCmd, len(keys))
+		for i, key := range keys {
+			getCmds[i] = pipe.Get(ctx, key)
+			ttlCmds[i] = pipe.PTTL(ctx, key)
+		}
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return unavailable(fmt.Errorf("Error reading leases from Redis: %w", err))
 		}
 
-		for _, keyStr := range sSlice {
-			pos := strings.IndexRune(keyStr, '-')
-			if pos == -1 {
+		for i, key := range keys {
+			hwAddr, err := net.ParseMAC(getCmds[i].Val())
+			if err != nil {
+				// expired between scan and read or not a lease
 				continue
 			}
 
-			for i := uint8(0); i < sc.maxTxRetryAttempts; i++ {
-				err := sc.client.Watch(ctx, func(tx *redis.Tx) error {
-					// check present of mapping
-					res, err := tx.Get(ctx, keyStr[:pos]).Result()
-					if err != nil {
-						return err
-					}
-
-					// check if the mac address corresponds with the one
-					// assigned and now expired
-					if keyStr[pos:] != res {
-						// a new assignment has been performed between the
-						// last two clean up
-						return nil
-					}
-
-					// delete the assignment from the mapping set
-					err = tx.Del(ctx, keyStr[:pos]).Err()
-					if err != nil {
-						return err
-					}
-
-					// set the bit related to the released ip to 0
-					err = tx.SetBit(ctx, LEASING_RANGE_BITSET, int64(dhcp4.IPRange(*sc.rangeStartIp, net.ParseIP(keyStr[:pos]))-1),
-						0).Err()
-					if err != nil {
-						return err
-					}
-
-					return nil
-				}, "ip:"+keyStr[:pos], LEASING_RANGE_BITSET)
-
-				if err == redis.Nil || err == nil {
-					// if nothing has been found or nothing gone wrong
-					// break the cycle
-					break
-				} else if err == redis.TxFailedErr {
-					// if the optimistic lock failed, retry
-					continue
-				} else {
-					// otherwise, show the error on provided logger
-					logger.Println(err)
-					break
-				}
+			lease := &Lease{
+				IP:     net.ParseIP(ks.ipFromKey(key)),
+				HwAddr: hwAddr,
+			}
+			if ttl := ttlCmds[i].Val(); ttl > 0 {
+				lease.Expiry = time.Now().Add(ttl)
+			}
+
+			if err := fn(lease); err != nil {
+				return err
 			}
 		}
 
-		for i := uint8(0); i < sc.maxTxRetryAttempts; i++ {
-			// remove all keys from the mapping set
-			err = sc.client.Watch(ctx, func(tx *redis.Tx) error {
-				err = tx.ZRemRangeByScore(ctx, IP_MAC_MAPPING_SET, "-inf", score).Err()
-				if err != nil {
-					return fmt.Errorf("Error removing range from Redis set: %s", err)
-				}
+		return nil
+	})
+}
 
-				return nil
-			}, IP_MAC_MAPPING_SET)
+func CleanUpAvailableIpRange(ctx context.Context, client redis.UniversalClient, ks Keyspace) error {
+	return deleteRangeBlocks(ctx, client, ks)
+}
 
-			if err == redis.TxFailedErr {
-				continue
-			} else if err != nil && err != redis.Nil {
-				break
-			} else if err != nil {
-				logger.Println(err)
-				break
+func CleanUpIpMacMapping(ctx context.Context, client redis.UniversalClient, ks Keyspace) error {
+	_, err := client.Del(ctx, ks.Key(IP_MAC_MAPPING_SET), ks.Key(IP_OWNERS_HASH)).Result()
+	if err != nil {
+		return fmt.Errorf("Error deleting Redis set %s: %s", ks.Key(IP_MAC_MAPPING_SET), err)
+	}
+
+	return nil
+}
+
+func CleanUpIpSets(ctx context.Context, client redis.UniversalClient, ks Keyspace) error {
+	return scanKeys(ctx, client, ks.ipKey("*"), func(keys []string) error {
+		for _, keyStr := range keys {
+			_, err := client.Del(ctx, keyStr).Result()
+			if err != nil {
+				return fmt.Errorf("Error deleting key %s from Redis: %s", keyStr, err)
 			}
 		}
-
-		logger.Println("DHCP db clean up performed")
-	}
+		return nil
+	})
 }
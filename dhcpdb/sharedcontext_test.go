@@ -0,0 +1,164 @@
+package dhcpdb
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+var (
+	testMAC  = net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}
+	otherMAC = net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x66}
+)
+
+// returns a client of an in memory Redis, closed at the end of the test
+func newTestClient(t *testing.T) (redis.UniversalClient, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return client, mr
+}
+
+// returns a shared context of the ranges, stored into the keyspace test of client
+func newTestContext(t *testing.T, client redis.UniversalClient, ranges ...string) *SharedContext {
+	ctx := context.Background()
+	ks := NewKeyspace("test")
+
+	pool, err := NewPool(ranges, nil, net.IPv4Mask(255, 255, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := InitPool(ctx, client, ks, pool, false); err != nil && err != ErrPoolInitialized {
+		t.Fatal(err)
+	}
+
+	sc := NewSharedContext(client, ks, pool)
+	if err := sc.LoadPool(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return sc
+}
+
+// returns the address offered by the store, failing the test if there is none
+func allocate(t *testing.T, store LeaseStore) net.IP {
+	ipAddr, err := store.GetFirstAvailableAddress(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *ipAddr
+}
+
+// returns the hardware address the address is leased to, nil if none
+func leasedTo(t *testing.T, store LeaseStore, ip string) net.HardwareAddr {
+	ipAddr := net.ParseIP(ip).To4()
+	hwAddr, err := store.GetPortMACMapping(context.Background(), &ipAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hwAddr == nil {
+		return nil
+	}
+	return *hwAddr
+}
+
+func TestSharedContextAllocate(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestClient(t)
+	sc := newTestContext(t, client, "10.0.0.10-10.0.0.12")
+
+	// offers are held, so every allocation gets another address
+	var offered []string
+	for i := 0; i < 3; i++ {
+		offered = append(offered, allocate(t, sc).String())
+	}
+	if want := []string{"10.0.0.10", "10.0.0.11", "10.0.0.12"}; !equalStrings(offered, want) {
+		t.Errorf("offered %v, want %v", offered, want)
+	}
+	if _, err := sc.GetFirstAvailableAddress(ctx); err != ErrPoolExhausted {
+		t.Fatalf("allocation of an exhausted pool: %v, want %v", err, ErrPoolExhausted)
+	}
+
+	// offers not requested in time are freed
+	if err := client.ZAdd(ctx, sc.ks.Key(ADDRESS_OFFERS_SET), &redis.Z{Score: 0, Member: 1}).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if freed, err := sc.ExpireOffers(ctx); err != nil || freed != 1 {
+		t.Fatalf("ExpireOffers() = %d, %v, want 1", freed, err)
+	}
+	if ipAddr := allocate(t, sc); !ipAddr.Equal(net.IPv4(10, 0, 0, 11)) {
+		t.Errorf("offered %s after the offer expiry, want 10.0.0.11", ipAddr)
+	}
+}
+
+func TestSharedContextBindings(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestClient(t)
+	sc := newTestContext(t, client, "10.0.0.10-10.0.0.12")
+
+	ipAddr := allocate(t, sc)
+	hwAddr, other := testMAC, otherMAC
+
+	if err := sc.AddIPMACMapping(ctx, &ipAddr, &hwAddr, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if got := leasedTo(t, sc, ipAddr.String()); got.String() != hwAddr.String() {
+		t.Fatalf("%s leased to %s, want %s", ipAddr, got, hwAddr)
+	}
+
+	if err := sc.AddIPMACMapping(ctx, &ipAddr, &other, time.Hour); !errors.Is(err, ErrConflict) {
+		t.Errorf("binding of a leased address: %v, want %v", err, ErrConflict)
+	}
+	if err := sc.RenewIPMACMapping(ctx, &ipAddr, &other, time.Hour); !errors.Is(err, ErrNotFound) {
+		t.Errorf("renewal by another client: %v, want %v", err, ErrNotFound)
+	}
+	if err := sc.RenewIPMACMapping(ctx, &ipAddr, &hwAddr, time.Hour); err != nil {
+		t.Errorf("renewal by the owner: %v", err)
+	}
+
+	// a release by another client leaves the lease in place
+	if err := sc.RemoveIPMapping(ctx, &ipAddr, &other); err != nil {
+		t.Fatal(err)
+	}
+	if got := leasedTo(t, sc, ipAddr.String()); got.String() != hwAddr.String() {
+		t.Fatalf("%s leased to %s after a release by another client, want %s", ipAddr, got, hwAddr)
+	}
+
+	if err := sc.RemoveIPMapping(ctx, &ipAddr, &hwAddr); err != nil {
+		t.Fatal(err)
+	}
+	if got := leasedTo(t, sc, ipAddr.String()); got != nil {
+		t.Fatalf("%s leased to %s after its release, want none", ipAddr, got)
+	}
+	if used, _, err := sc.Usage(ctx); err != nil || used != 0 {
+		t.Errorf("Usage() = %d, %v after the release, want 0", used, err)
+	}
+	if again := allocate(t, sc); !again.Equal(ipAddr) {
+		t.Errorf("offered %s after the release, want %s", again, ipAddr)
+	}
+}
+
+func TestSharedContextStalePool(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestClient(t)
+	sc := newTestContext(t, client, "10.0.0.10")
+	other := newTestContext(t, client, "10.0.0.10")
+
+	allocate(t, sc)
+	if _, err := sc.GetFirstAvailableAddress(ctx); err != ErrPoolExhausted {
+		t.Fatalf("allocation of an exhausted pool: %v, want %v", err, ErrPoolExhausted)
+	}
+
+	// the scripts refuse the stale pool of sc, which is reloaded
+	r, _ := ParseIPRange("10.0.0.20")
+	if err := other.GrowPool(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+	if ipAddr := allocate(t, sc); !ipAddr.Equal(net.IPv4(10, 0, 0, 20)) {
+		t.Errorf("offered %s after the pool grew, want 10.0.0.20", ipAddr)
+	}
+}
@@ -0,0 +1,272 @@
+package dhcpdb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	SNAPSHOT_MAGIC   = "faasdhcp-snapshot"
+	SNAPSHOT_VERSION = 1
+)
+
+/*
+SnapshotLease is a lease of a snapshot. TTL is the time left before expiry when
+the snapshot was taken, zero for infinite leases.
+*/
+type SnapshotLease struct {
+	IP  string        `json:"ip"`
+	MAC string        `json:"mac"`
+	TTL time.Duration `json:"ttl,omitempty"`
+}
+
+/*
+Snapshot is the whole state of a dhcpdb keyspace. The leasing range is not
+stored as such, it is rebuilt from the pool and the leases on restore; key
+names are relative to the keyspace, so a snapshot can be restored under
+another prefix.
+*/
+type Snapshot struct {
+	Version       int                 `json:"version"`
+	Created       time.Time           `json:"created"`
+	Pool          *Pool               `json:"pool"`
+	Leases        []SnapshotLease     `json:"leases"`
+	Reservations  map[string]string   `json:"reservations,omitempty"`
+	BootpRange    []byte              `json:"bootpRange,omitempty"`
+	BootpBindings map[string]string   `json:"bootpBindings,omitempty"`
+	AccessLists   map[string][]string `json:"accessLists,omitempty"`
+}
+
+/*
+Takes a snapshot of the keyspace. The leases are read while the replicas keep
+serving, so the snapshot is consistent lease by lease, not as a whole.
+*/
+func (sc *SharedContext) TakeSnapshot(ctx context.Context) (*Snapshot, error) {
+	if err := sc.LoadPool(ctx); err != nil {
+		return nil, err
+	}
+
+	snap := &Snapshot{
+		Version: SNAPSHOT_VERSION,
+		Created: time.Now(),
+		Pool:    sc.Pool().clone(),
+	}
+
+	err := sc.ForEachMapping(ctx, func(l *Lease) error {
+		lease := SnapshotLease{IP: l.IP.String(), MAC: l.HwAddr.String()}
+		if !l.Expiry.IsZero() {
+			if lease.TTL = l.Expiry.Sub(snap.Created); lease.TTL <= 0 {
+				return nil
+			}
+		}
+		snap.Leases = append(snap.Leases, lease)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if snap.Reservations, err = sc.Reservations().All(ctx); err != nil {
+		return nil, err
+	}
+
+	snap.BootpRange, err = sc.client.Get(ctx, sc.ks.Key(BOOTP_RANGE_BITSET)).Bytes()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("Error reading %s: %s", BOOTP_RANGE_BITSET, err)
+	}
+
+	if snap.BootpBindings, err = sc.client.HGetAll(ctx, sc.ks.Key(BOOTP_BINDINGS_HASH)).Result(); err != nil {
+		return nil, fmt.Errorf("Error reading %s: %s", BOOTP_BINDINGS_HASH, err)
+	}
+
+	snap.AccessLists = make(map[string][]string)
+	for _, list := range []string{ACL_ALLOW_LIST, ACL_DENY_LIST} {
+		err := scanKeys(ctx, sc.client, sc.ks.Key(list+":*"), func(keys []string) error {
+			for _, key := range keys {
+				members, err := sc.client.SMembers(ctx, key).Result()
+				if err != nil {
+					return err
+				}
+				snap.AccessLists[strings.TrimPrefix(key, sc.ks.Key(""))] = members
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Error reading access lists: %s", err)
+		}
+	}
+
+	return snap, nil
+}
+
+/*
+Replaces the state of the keyspace with the snapshot. The leasing range is
+rebuilt and every lease is bound again with the time to live it had when the
+snapshot was taken, counted from now, so clients keep their addresses. The
+leases are checked against the snapshot pool before anything is deleted. The
+replicas should not serve requests during the restore.
+*/
+func (sc *SharedContext) RestoreSnapshot(ctx context.Context, snap *Snapshot) error {
+	if snap.Pool == nil {
+		return fmt.Errorf("Error snapshot without pool definition")
+	}
+	pool := snap.Pool.clone()
+	if err := pool.Validate(); err != nil {
+		return err
+	}
+
+	type lease struct {
+		ip  net.IP
+		mac net.HardwareAddr
+		ttl time.Duration
+	}
+	leases := make([]lease, 0, len(snap.Leases))
+	owners := make(map[string]string, len(snap.Leases))
+	for _, l := range snap.Leases {
+		ipAddr := net.ParseIP(l.IP).To4()
+		hwAddr, err := net.ParseMAC(l.MAC)
+		if ipAddr == nil || err != nil {
+			return fmt.Errorf("Error invalid lease %s - %s into snapshot", l.IP, l.MAC)
+		}
+		if _, ok := pool.Index(ipAddr); !ok || pool.Excluded(ipAddr) {
+			return fmt.Errorf("Error lease %s - %s into snapshot outside the pool", l.IP, l.MAC)
+		}
+		if l.TTL < 0 {
+			return fmt.Errorf("Error lease %s - %s into snapshot with negative time to live", l.IP, l.MAC)
+		}
+		if owner, ok := owners[ipAddr.String()]; ok && owner != hwAddr.String() {
+			return fmt.Errorf("Error address %s leased to both %s and %s into snapshot", l.IP, owner, hwAddr)
+		}
+		owners[ipAddr.String()] = hwAddr.String()
+		leases = append(leases, lease{ip: ipAddr, mac: hwAddr, ttl: l.TTL})
+	}
+
+	if err := CleanUpIpSets(ctx, sc.client, sc.ks); err != nil {
+		return err
+	}
+	if err := CleanUpIpMacMapping(ctx, sc.client, sc.ks); err != nil {
+		return err
+	}
+	if err := InitPool(ctx, sc.client, sc.ks, pool, true); err != nil {
+		return err
+	}
+	sc.pool.Store(pool)
+
+	for _, l := range leases {
+		if err := sc.AddIPMACMapping(ctx, &l.ip, &l.mac, l.ttl); err != nil {
+			return err
+		}
+	}
+
+	_, err := sc.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, sc.ks.Key(RESERVATIONS_HASH), sc.ks.Key(BOOTP_RANGE_BITSET), sc.ks.Key(BOOTP_BINDINGS_HASH))
+		for mac, ip := range snap.Reservations {
+			pipe.HSet(ctx, sc.ks.Key(RESERVATIONS_HASH), mac, ip)
+		}
+		if len(snap.BootpRange) > 0 {
+			pipe.Set(ctx, sc.ks.Key(BOOTP_RANGE_BITSET), snap.BootpRange, 0)
+		}
+		for mac, ip := range snap.BootpBindings {
+			pipe.HSet(ctx, sc.ks.Key(BOOTP_BINDINGS_HASH), mac, ip)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error restoring reservations: %s", err)
+	}
+
+	for _, list := range []string{ACL_ALLOW_LIST, ACL_DENY_LIST} {
+		err := scanKeys(ctx, sc.client, sc.ks.Key(list+":*"), func(keys []string) error {
+			return sc.client.Del(ctx, keys...).Err()
+		})
+		if err != nil {
+			return fmt.Errorf("Error deleting access lists: %s", err)
+		}
+	}
+	for name, members := range snap.AccessLists {
+		if len(members) == 0 {
+			continue
+		}
+		values := make([]interface{}, len(members))
+		for i, m := range members {
+			values[i] = m
+		}
+		if err := sc.client.SAdd(ctx, sc.ks.Key(name), values...).Err(); err != nil {
+			return fmt.Errorf("Error restoring access list %s: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+/*
+Writes the snapshot as a header line, holding the format version and the
+SHA-256 of the body, followed by the JSON body.
+*/
+func WriteSnapshot(w io.Writer, snap *Snapshot) error {
+	body, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("Error encoding snapshot: %s", err)
+	}
+
+	sum := sha256.Sum256(body)
+	if _, err := fmt.Fprintf(w, "%s %d %s\n", SNAPSHOT_MAGIC, SNAPSHOT_VERSION, hex.EncodeToString(sum[:])); err != nil {
+		return err
+	}
+	_, err = w.Write(body)
+	return err
+}
+
+/*
+Reads a snapshot written by WriteSnapshot, checking its version and checksum.
+*/
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	reader := bufio.NewReader(r)
+
+	header, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("Error reading snapshot header: %s", err)
+	}
+
+	var magic, checksum string
+	var version int
+	if _, err := fmt.Sscanf(header, "%s %d %s", &magic, &version, &checksum); err != nil || magic != SNAPSHOT_MAGIC {
+		return nil, fmt.Errorf("Error not a snapshot file")
+	}
+	if version != SNAPSHOT_VERSION {
+		return nil, fmt.Errorf("Error unsupported snapshot version %d", version)
+	}
+
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading snapshot: %s", err)
+	}
+	body = bytes.TrimRight(body, "\n")
+
+	sum := sha256.Sum256(body)
+	if hex.EncodeToString(sum[:]) != checksum {
+		return nil, fmt.Errorf("Error snapshot checksum mismatch")
+	}
+
+	snap := new(Snapshot)
+	if err := json.Unmarshal(body, snap); err != nil {
+		return nil, fmt.Errorf("Error decoding snapshot: %s", err)
+	}
+	if snap.Version != SNAPSHOT_VERSION {
+		return nil, fmt.Errorf("Error unsupported snapshot version %d", snap.Version)
+	}
+
+	return snap, nil
+}
@@ -0,0 +1,81 @@
+package dhcpdb
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestClient(t)
+	sc := newTestContext(t, client, "10.0.0.10-10.0.0.19")
+
+	leased, infinite := net.IPv4(10, 0, 0, 10).To4(), net.IPv4(10, 0, 0, 11).To4()
+	hwAddr, other := testMAC, otherMAC
+	if err := sc.AddIPMACMapping(ctx, &leased, &hwAddr, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := sc.AddIPMACMapping(ctx, &infinite, &other, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := sc.Reservations().Add(ctx, hwAddr, net.IPv4(10, 0, 1, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := sc.TakeSnapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WriteSnapshot(&buf, snap); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	read, err := ReadSnapshot(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// restored under another prefix
+	restored := NewSharedContext(client, NewKeyspace("restored"), read.Pool.clone())
+	if err := restored.RestoreSnapshot(ctx, read); err != nil {
+		t.Fatal(err)
+	}
+	if got := leasedTo(t, restored, leased.String()); got.String() != hwAddr.String() {
+		t.Errorf("%s leased to %s after the restore, want %s", leased, got, hwAddr)
+	}
+	if got := leasedTo(t, restored, infinite.String()); got.String() != other.String() {
+		t.Errorf("%s leased to %s after the restore, want %s", infinite, got, other)
+	}
+	if ipAddr, err := restored.Reservations().Get(ctx, hwAddr); err != nil || ipAddr == nil || !ipAddr.Equal(net.IPv4(10, 0, 1, 1)) {
+		t.Errorf("reservation of %s = %v, %v after the restore, want 10.0.1.1", hwAddr, ipAddr, err)
+	}
+	report, err := restored.Fsck(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Clean() {
+		t.Errorf("Fsck() found %+v after the restore, want clean", report)
+	}
+
+	// a snapshot altered after being written is refused
+	corrupted := append([]byte(nil), data...)
+	corrupted[len(corrupted)-2] ^= 1
+	if _, err := ReadSnapshot(bytes.NewReader(corrupted)); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("ReadSnapshot() of a corrupted snapshot: %v, want a checksum error", err)
+	}
+
+	// a lease outside the pool is refused before anything is deleted
+	read.Leases = append(read.Leases, SnapshotLease{IP: "10.0.1.20", MAC: other.String()})
+	if err := restored.RestoreSnapshot(ctx, read); err == nil {
+		t.Fatalf("RestoreSnapshot() of a lease outside the pool succeeded, want error")
+	}
+	if got := leasedTo(t, restored, leased.String()); got.String() != hwAddr.String() {
+		t.Errorf("%s leased to %s after a refused restore, want %s", leased, got, hwAddr)
+	}
+}
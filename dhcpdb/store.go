@@ -0,0 +1,38 @@
+package dhcpdb
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+/*
+Lease is a binding between an IP address and a hardware address.
+*/
+type Lease struct {
+	IP     net.IP
+	HwAddr net.HardwareAddr
+	Expiry time.Time
+}
+
+/*
+LeaseStore is the storage backend of the leases distributed by the DHCP
+handler. SharedContext is the Redis implementation shared between replicas,
+MemStore keeps everything in process memory.
+*/
+type LeaseStore interface {
+	// Returns an address of the range not leased yet, to offer to a client.
+	// Shared stores hold it for a short time, until bound or expired
+	GetFirstAvailableAddress(ctx context.Context) (*net.IP, error)
+	// Binds the address to the hardware address for leaseTime
+	AddIPMACMapping(ctx context.Context, ipAddr *net.IP, hwAddr *net.HardwareAddr, leaseTime time.Duration) error
+	// Extends for leaseTime the lease of an address bound to the hardware address
+	RenewIPMACMapping(ctx context.Context, ipAddr *net.IP, hwAddr *net.HardwareAddr, leaseTime time.Duration) error
+	// Releases the address if bound to the hardware address
+	RemoveIPMapping(ctx context.Context, ipAddr *net.IP, hwAddr *net.HardwareAddr) error
+	// Returns the hardware address bound to the address, nil if not leased
+	GetPortMACMapping(ctx context.Context, ipAddr *net.IP) (*net.HardwareAddr, error)
+	// Calls fn for every active lease, stopping at the first error returned
+	ForEachMapping(ctx context.Context, fn func(*Lease) error) error
+	Close() error
+}
@@ -1,19 +1,31 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"dhcpdb"
 	"nflib"
 	"utils"
 
+	"github.com/go-redis/redis/v8"
 	"github.com/krolaw/dhcp4"
 )
 
+const (
+	DHCP_SERVER_PORT = 67
+	DHCP_CLIENT_PORT = 68
+)
+
 // func main() {
 // 	/*serverIp := &net.IP{192, 168, 1, 249}
 // 	startIp := &net.IP{192, 168, 1, 115}
@@ -39,16 +51,46 @@ func Main(obj map[string]interface{}) map[string]interface{} {
 	lIp, _ := nflib.GetLocalIpAddr()
 	strPrefix := fmt.Sprintf("[%s] -> ", lIp.String())
 
-	redisIp, ok := obj["redisIp"].(string)
-	if !ok {
-		log.Fatalf("Error casting redisIp provided parameter as string\n")
+	// only the redis store needs Redis, the others log on stderr
+	storeType := getStringParam(obj, "store", "redis")
+	if storeType == "redis" {
+		redisIp, ok := obj["redisIp"].(string)
+		if !ok {
+			log.Fatalf("Error casting redisIp provided parameter as string\n")
+		}
+
+		logger, err := nflib.NewRedisLogger(strPrefix, "logChan", redisIp, nflib.REDIS_PORT)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		utils.Log = logger
+	} else {
+		utils.Log = log.New(os.Stderr, strPrefix, log.Ldate|log.Lmicroseconds)
 	}
 
-	logger, err := nflib.NewRedisLogger(strPrefix, "logChan", redisIp, nflib.REDIS_PORT)
-	if err != nil {
-		log.Fatalln(err)
+	// cancelled at shutdown, interrupting the in-flight transactions
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		defer signal.Stop(signals)
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// background tasks, waited for at shutdown so they can clean up
+	var tasks sync.WaitGroup
+	background := func(task func(ctx context.Context)) {
+		tasks.Add(1)
+		go func() {
+			defer tasks.Done()
+			task(ctx)
+		}()
 	}
-	utils.Log = logger
 
 	cntIdStr, ok := obj["cntId"].(string)
 	if !ok {
@@ -75,39 +117,303 @@ func Main(obj map[string]interface{}) map[string]interface{} {
 	utils.Log.Printf("Starting DHCP NF at %s ...", lIp)
 
 	serverIp := nflib.GetGatewayIP()
-	startIp := &net.IP{192, 168, 1, 115}
 	subnetIp := &net.IP{255, 255, 255, 0}
+	if mask := net.ParseIP(getStringParam(obj, "subnetMask", "")).To4(); mask != nil {
+		subnetIp = &mask
+	}
 	routerIp := &net.IP{192, 168, 1, 254}
 	dnsIp := &net.IP{192, 168, 1, 254}
-	client := dhcpdb.NewRedisClient(serverIp.String(), 6379)
+	redisOpts := &dhcpdb.RedisOptions{
+		Addrs:            strings.Split(getStringParam(obj, "redisAddrs", serverIp.String()+":6379"), ","),
+		Username:         getStringParam(obj, "redisUser", ""),
+		Password:         getStringParam(obj, "redisPassword", ""),
+		DB:               getIntParam(obj, "redisDB", 0),
+		TLS:              getStringParam(obj, "redisTLS", "0") != "0",
+		CACert:           getStringParam(obj, "redisCA", ""),
+		TLSServerName:    getStringParam(obj, "redisTLSServerName", ""),
+		MasterName:       getStringParam(obj, "redisMaster", ""),
+		SentinelPassword: getStringParam(obj, "redisSentinelPassword", ""),
+		Cluster:          getStringParam(obj, "redisCluster", "0") != "0",
+	}
+	ks := dhcpdb.NewKeyspace(getStringParam(obj, "keyPrefix", ""))
+
+	var client redis.UniversalClient
+	if storeType == "redis" {
+		if client, err = dhcpdb.NewRedisClient(redisOpts); err != nil {
+			utils.Log.Fatalln(err)
+		}
+
+		if redisOpts.Cluster && ks.Prefix() == "" {
+			utils.Log.Fatalf("Error keyPrefix parameter required with Redis Cluster")
+		}
+
+		if getStringParam(obj, "migrateKeys", "0") != "0" {
+			if err := dhcpdb.MigrateUnprefixedKeys(ctx, client, ks); err != nil {
+				utils.Log.Fatalln(err)
+			}
+			utils.Log.Printf("Unprefixed keys migrated into keyspace %s\n", ks.Prefix())
+		}
+	} else {
+		// the features below share their state between replicas through Redis
+		for _, param := range []string{"audit", "bootp", "acl", "rateMac", "rateRelay", "rateGlobal", "maxRelayLeases", "burstClients"} {
+			if getStringParam(obj, param, "0") != "0" {
+				utils.Log.Fatalf("Error %s parameter requires the redis store\n", param)
+			}
+		}
+	}
 
 	nflib.SendPingMessageToRouter("dhcp", utils.Log, utils.Log, uint16(cntId), repl)
 
-	handler := NewHandler(&serverIp, startIp, subnetIp, routerIp, dnsIp, 1000000000, time.Hour, client)
-	defer handler.Close()
-	utils.Log.Println("Starting accepting UDP packets ...")
-	utils.Log.Println(ListenAndServe(handler, 9826))
+	var exclusions []string
+	if exclStr := getStringParam(obj, "poolExclusions", ""); exclStr != "" {
+		exclusions = strings.Split(exclStr, ",")
+	}
+
+	ranges := strings.Split(getStringParam(obj, "poolRanges", "192.168.1.115-192.168.1.253"), ",")
+	pool, err := dhcpdb.NewPool(ranges, exclusions, net.IPMask(*subnetIp))
+	if err != nil {
+		utils.Log.Fatalln(err)
+	}
+	pool.Exclude(serverIp)
+	pool.Exclude(*routerIp)
+	pool.Exclude(*dnsIp)
+
+	var audit *dhcpdb.AuditLog
+	if getStringParam(obj, "audit", "0") != "0" {
+		audit = dhcpdb.NewAuditLog(client, ks, int64(getIntParam(obj, "auditMaxLen", dhcpdb.DEFAULT_AUDIT_MAXLEN)),
+			time.Duration(getIntParam(obj, "auditRetentionDays", 90))*24*time.Hour)
+	}
+
+	var store dhcpdb.LeaseStore
+	var sc *dhcpdb.SharedContext
+	switch storeType {
+	case "redis":
+		if err := dhcpdb.LoadScripts(ctx, client); err != nil {
+			utils.Log.Println(err)
+		}
+		// the first replica stores the pool, the others load it; initPool=force
+		// replaces the stored pool with the one of the parameters
+		force := getStringParam(obj, "initPool", "0") == "force"
+		if err := dhcpdb.InitPool(ctx, client, ks, pool, force); err == nil {
+			utils.Log.Printf("Pool %v initialized\n", pool.Ranges)
+		} else if err != dhcpdb.ErrPoolInitialized {
+			utils.Log.Fatalln(err)
+		}
+		sc = dhcpdb.NewSharedContext(client, ks, pool)
+		if err := sc.LoadPool(ctx); err != nil {
+			utils.Log.Fatalln(err)
+		}
+		if cmd := getStringParam(obj, "cmd", ""); cmd != "" {
+			return runCommand(ctx, sc, audit, obj, cmd)
+		}
+		if getStringParam(obj, "reaper", "1") != "0" {
+			reaper := dhcpdb.NewReaper(sc, time.Duration(getIntParam(obj, "reapInterval", 60))*time.Second, utils.Log)
+			if audit != nil {
+				reaper.OnExpire = func(event *dhcpdb.LeaseEvent) {
+					err := audit.Record(ctx, &dhcpdb.AuditEvent{Type: dhcpdb.AUDIT_EXPIRE, Time: event.Time, IP: event.IP, MAC: event.MAC})
+					if err != nil {
+						utils.Log.Println(err)
+					}
+				}
+			}
+			background(func(ctx context.Context) { reaper.Run(ctx) })
+		}
+		store = sc
+		if blockSize := getIntParam(obj, "addressBlock", 0); blockSize > 0 {
+			blockStore := dhcpdb.NewBlockStore(sc, blockSize, time.Duration(getIntParam(obj, "blockTTL", 30))*time.Second,
+				time.Duration(getIntParam(obj, "blockIdle", 300))*time.Second, utils.Log)
+			background(func(ctx context.Context) { blockStore.Run(ctx) })
+			store = blockStore
+		}
+	case "memory":
+		store = dhcpdb.NewMemStore(pool)
+	case "file":
+		fileStore, err := dhcpdb.OpenFileStore(getStringParam(obj, "leaseFile", "leases.log"), pool)
+		if err != nil {
+			utils.Log.Fatalln(err)
+		}
+		store = fileStore
+	default:
+		utils.Log.Fatalf("Error unknown lease store %s", storeType)
+	}
 
-	utils.Log.Println("Function terminated due to an error")
+	handler := NewHandler(&serverIp, subnetIp, routerIp, dnsIp, pool, time.Hour, store)
+	defer func() {
+		// the store is closed once the background tasks are done with it
+		cancel()
+		tasks.Wait()
+		handler.Close()
+	}()
+
+	handler.ctx = ctx
+	handler.authoritative = getStringParam(obj, "authoritative", "1") != "0"
+	handler.audit = audit
+	if sc != nil {
+		handler.reservations = sc.Reservations()
+	}
+
+	if sc != nil && getStringParam(obj, "degraded", "1") != "0" {
+		// localBlock lists the candidate blocks, each replica claims one of them
+		var block *dhcpdb.Pool
+		blockTTL := time.Duration(getIntParam(obj, "localBlockTTL", int(dhcpdb.DEFAULT_LOCAL_BLOCK_TTL/time.Second))) * time.Second
+		if blocks := getStringParam(obj, "localBlock", ""); blocks != "" {
+			if block, err = claimLocalBlock(ctx, sc, blocks, blockTTL); err != nil {
+				utils.Log.Fatalln(err)
+			} else if block == nil {
+				utils.Log.Printf("Local blocks %s held by other replicas\n", blocks)
+			}
+		}
+		handler.degraded = newDegradedMode(block, getIntParam(obj, "degradedQueue", 10000))
+		if err := handler.degraded.load(ctx, sc); err != nil {
+			utils.Log.Fatalln(err)
+		}
+		background(func(ctx context.Context) { handler.degraded.hold(ctx, sc, blockTTL) })
+		background(func(ctx context.Context) { handler.degraded.run(ctx, sc, 5*time.Second) })
+	}
+
+	if cacheSize := getIntParam(obj, "leaseCache", 1024); cacheSize > 0 {
+		// entries live as long as the leases unless a shorter time to live is set
+		cacheTTL := getIntParam(obj, "leaseCacheTTL", int(handler.leaseDuration/time.Second))
+		handler.leases = newLeaseCache(cacheSize, time.Duration(cacheTTL)*time.Second)
+		if sc != nil {
+			background(func(ctx context.Context) { handler.leases.follow(ctx, sc) })
+		}
+	}
+
+	if getStringParam(obj, "bootp", "0") != "0" {
+		handler.bootpMode = true
+		if bootpStart := net.ParseIP(getStringParam(obj, "bootpStart", "")).To4(); bootpStart != nil {
+			bootpRange := uint32(getIntParam(obj, "bootpRange", 0))
+			if bootpRange > 0 {
+				r := dhcpdb.IPRange{Start: bootpStart, End: dhcp4.IPAdd(bootpStart, int(bootpRange)-1)}
+				for _, poolRange := range handler.currentPool().Ranges {
+					if r.Overlaps(poolRange) {
+						utils.Log.Fatalf("Error BOOTP pool %s overlaps the DHCP pool range %s\n", r, poolRange)
+					}
+				}
+			}
+			handler.bootpPool = dhcpdb.NewBootpPool(client, ks, &bootpStart, bootpRange, 5)
+		}
+	}
+
+	if getStringParam(obj, "acl", "0") != "0" {
+		handler.acl = dhcpdb.NewAccessControl(client, ks, getStringParam(obj, "pool", "default"))
+		handler.nakDenied = getStringParam(obj, "aclDenyAction", "ignore") == "nak"
+	}
+
+	limits := dhcpdb.RateLimits{
+		Window:         time.Duration(getIntParam(obj, "rateWindow", 1)) * time.Second,
+		PerMAC:         int64(getIntParam(obj, "rateMac", 0)),
+		PerRelay:       int64(getIntParam(obj, "rateRelay", 0)),
+		Global:         int64(getIntParam(obj, "rateGlobal", 0)),
+		MaxRelayLeases: int64(getIntParam(obj, "maxRelayLeases", 0)),
+		BurstClients:   int64(getIntParam(obj, "burstClients", 0)),
+	}
+	if limits.PerMAC > 0 || limits.PerRelay > 0 || limits.Global > 0 || limits.MaxRelayLeases > 0 || limits.BurstClients > 0 {
+		handler.limiter = dhcpdb.NewRateLimiter(client, ks, limits)
+	}
+
+	bcast := net.ParseIP(getStringParam(obj, "broadcastAddr", "10.10.1.2"))
+	if bcast == nil {
+		utils.Log.Fatalf("Error parsing broadcastAddr parameter: %v", obj["broadcastAddr"])
+	}
+
+	utils.Log.Println("Starting accepting UDP packets ...")
+	if err := ListenAndServe(ctx, handler, 9826, bcast); err != errTerminated && ctx.Err() == nil {
+		utils.Log.Println(err)
+		utils.Log.Println("Function terminated due to an error")
+	} else {
+		utils.Log.Println("Function terminated")
+	}
 
 	res := make(map[string]interface{})
 	return res
 }
 
-func ListenAndServe(handler dhcp4.Handler, port int) error {
+// Returns the string parameter name from the function input, or def if not provided
+func getStringParam(obj map[string]interface{}, name, def string) string {
+	if v, ok := obj[name].(string); ok && v != "" {
+		return v
+	}
+	return def
+}
+
+// Returns the integer parameter name from the function input, or def if not provided or invalid
+func getIntParam(obj map[string]interface{}, name string, def int) int {
+	str := getStringParam(obj, name, "")
+	if str == "" {
+		return def
+	}
+
+	v, err := strconv.Atoi(str)
+	if err != nil {
+		utils.Log.Printf("Error converting parameter %s value %s into integer, using %d\n", name, str, def)
+		return def
+	}
+	return v
+}
+
+func ListenAndServe(ctx context.Context, handler dhcp4.Handler, port int, bcast net.IP) error {
 	conn, err := NewSFServerConn(port)
 	if err != nil {
 		return err
 	}
-	defer conn.Close()
-	return Serve(conn, handler)
+
+	// closing the connection unblocks the read of the next packet at shutdown
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	return Serve(conn, handler, bcast)
 }
 
-func Serve(conn dhcp4.ServeConn, handler dhcp4.Handler) error {
+/*
+Returns the destination of a reply following the RFC 2131 section 4.1 rules:
+relayed requests are answered to the relay agent on the server port, NAKs and
+renewals are sent to ciaddr and everything else is broadcast. A client with no
+address yet can only be reached at yiaddr through a link layer unicast to
+chaddr, which a UDP socket cannot send, so those replies are broadcast even
+without the broadcast flag. bcast is the broadcast (or tunnel) endpoint of the
+deployment.
+*/
+func replyAddr(req, res dhcp4.Packet, bcast net.IP) net.Addr {
+	t := res.ParseOptions()[dhcp4.OptionDHCPMessageType]
+	isNak := len(t) == 1 && dhcp4.MessageType(t[0]) == dhcp4.NAK
+
+	if giaddr := req.GIAddr(); !giaddr.Equal(net.IPv4zero) {
+		if isNak {
+			res.SetBroadcast(true)
+		}
+		return &net.UDPAddr{IP: giaddr, Port: DHCP_SERVER_PORT}
+	}
+
+	if isNak {
+		return &net.UDPAddr{IP: bcast, Port: DHCP_CLIENT_PORT}
+	}
+
+	if ciaddr := req.CIAddr(); !ciaddr.Equal(net.IPv4zero) {
+		return &net.UDPAddr{IP: ciaddr, Port: DHCP_CLIENT_PORT}
+	}
+
+	return &net.UDPAddr{IP: bcast, Port: DHCP_CLIENT_PORT}
+}
+
+// Implemented by handlers able to answer to plain BOOTP requests
+type bootpHandler interface {
+	ServeBOOTP(req dhcp4.Packet, options dhcp4.Options) dhcp4.Packet
+}
+
+func Serve(conn dhcp4.ServeConn, handler dhcp4.Handler, bcast net.IP) error {
 	buffer := make([]byte, 1500)
 
 	for {
-		n, addr, err := conn.ReadFrom(buffer)
+		n, _, err := conn.ReadFrom(buffer)
 		if err != nil {
 			return err
 		}
@@ -123,27 +429,24 @@ func Serve(conn dhcp4.ServeConn, handler dhcp4.Handler) error {
 
 		options := req.ParseOptions()
 		var reqType dhcp4.MessageType
-		if t := options[dhcp4.OptionDHCPMessageType]; len(t) != 1 {
+		var res dhcp4.Packet
+		if t := options[dhcp4.OptionDHCPMessageType]; len(t) == 0 && req.OpCode() == dhcp4.BootRequest {
+			// no message type, plain BOOTP request
+			if bh, ok := handler.(bootpHandler); ok {
+				res = bh.ServeBOOTP(req, options)
+			}
+		} else if len(t) != 1 {
 			continue
 		} else {
 			reqType = dhcp4.MessageType(t[0])
 			if reqType < dhcp4.Discover || reqType > dhcp4.Inform {
 				continue
 			}
+			res = handler.ServeDHCP(req, reqType, options)
 		}
 
-		if res := handler.ServeDHCP(req, reqType, options); res != nil {
-			// If IP not available, broadcast
-			ipStr, portStr, err := net.SplitHostPort(addr.String())
-			if err != nil {
-				return err
-			}
-
-			if net.ParseIP(ipStr).Equal(net.IPv4zero) || req.Broadcast() {
-				port, _ := strconv.Atoi(portStr)
-				addr = &net.UDPAddr{IP: net.IPv4(10, 10, 1, 2), Port: port}
-			}
-			if _, e := conn.WriteTo(res, addr); e != nil {
+		if res != nil {
+			if _, e := conn.WriteTo(res, replyAddr(req, res, bcast)); e != nil {
 				return e
 			}
 		}
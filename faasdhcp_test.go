@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/krolaw/dhcp4"
+)
+
+func TestReplyAddr(t *testing.T) {
+	bcast := net.IPv4(10, 0, 0, 255)
+	clientIP := net.IPv4(10, 0, 0, 20)
+	relayIP := net.IPv4(10, 1, 0, 1)
+	hwAddr := net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}
+
+	tests := []struct {
+		name          string
+		msgType       dhcp4.MessageType
+		ciaddr        net.IP
+		giaddr        net.IP
+		broadcast     bool
+		want          net.UDPAddr
+		wantBroadcast bool
+	}{
+		{name: "offer", msgType: dhcp4.Offer, want: net.UDPAddr{IP: bcast, Port: DHCP_CLIENT_PORT}},
+		{name: "broadcast flag", msgType: dhcp4.Offer, broadcast: true, want: net.UDPAddr{IP: bcast, Port: DHCP_CLIENT_PORT}, wantBroadcast: true},
+		{name: "renewal", msgType: dhcp4.ACK, ciaddr: clientIP, broadcast: true, want: net.UDPAddr{IP: clientIP, Port: DHCP_CLIENT_PORT}, wantBroadcast: true},
+		{name: "nak", msgType: dhcp4.NAK, ciaddr: clientIP, want: net.UDPAddr{IP: bcast, Port: DHCP_CLIENT_PORT}},
+		{name: "relayed", msgType: dhcp4.ACK, giaddr: relayIP, want: net.UDPAddr{IP: relayIP, Port: DHCP_SERVER_PORT}},
+		{name: "relayed nak", msgType: dhcp4.NAK, giaddr: relayIP, want: net.UDPAddr{IP: relayIP, Port: DHCP_SERVER_PORT}, wantBroadcast: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := dhcp4.RequestPacket(dhcp4.Request, hwAddr, tt.ciaddr, []byte{1, 2, 3, 4}, tt.broadcast, nil)
+			if tt.giaddr != nil {
+				req.SetGIAddr(tt.giaddr)
+			}
+			res := dhcp4.ReplyPacket(req, tt.msgType, net.IPv4(10, 0, 0, 1), clientIP, 0, nil)
+			if tt.msgType == dhcp4.NAK {
+				res.SetYIAddr(net.IPv4zero)
+			}
+
+			addr, ok := replyAddr(req, res, bcast).(*net.UDPAddr)
+			if !ok || !addr.IP.Equal(tt.want.IP) || addr.Port != tt.want.Port {
+				t.Errorf("replyAddr() = %v, want %v", addr, &tt.want)
+			}
+			if res.Broadcast() != tt.wantBroadcast {
+				t.Errorf("reply broadcast flag = %t, want %t", res.Broadcast(), tt.wantBroadcast)
+			}
+		})
+	}
+}
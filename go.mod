@@ -10,6 +10,7 @@ replace utils => ./utils
 
 require (
 	dhcpdb v0.0.0-00010101000000-000000000000
+	github.com/alicebob/miniredis/v2 v2.30.0
 	github.com/go-redis/redis/v8 v8.4.0
 	github.com/google/btree v1.0.0 // indirect
 	github.com/google/netstack v0.0.0-20191123085552-55fcc16cd0eb
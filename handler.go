@@ -1,67 +1,362 @@
 package main
 
 import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
 	"net"
-	"os"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"dhcpdb"
 	"utils"
 
-	"github.com/go-redis/redis/v8"
 	"github.com/google/netstack/tcpip/header"
 	dhcp "github.com/krolaw/dhcp4"
 	"golang.org/x/net/ipv4"
 )
 
-type lease struct {
-	nic    string    // Client's CHAddr
-	expiry time.Time // When the lease expires
-}
-
 type DHCPHandler struct {
+	poolReloaded  int64         // Last pool reload of inPool in nanoseconds since the epoch, first for 64-bit alignment
 	ip            net.IP        // Server IP to use
 	options       dhcp.Options  // Options to send to DHCP Clients
-	start         net.IP        // Start of IP range to distribute
-	leaseRange    int           // Number of IPs to distribute (starting from start)
+	pool          *dhcpdb.Pool  // Addresses to distribute, unless shared by the store (see currentPool)
 	leaseDuration time.Duration // Lease period
-	leases        map[int]lease // Map to keep track of leases
-	sc            *dhcpdb.SharedContext
+	leases        *leaseCache   // Recent bindings, nil if disabled
+	store         dhcpdb.LeaseStore
+	acl           *dhcpdb.AccessControl // Allow/deny lists, nil if disabled
+	nakDenied     bool                  // NAK denied clients instead of ignoring them
+	limiter       *dhcpdb.RateLimiter   // Shared rate limits, nil if disabled
+	authoritative bool                  // NAK requests for addresses outside of the pool
+	bootpMode     bool                  // Answer to plain BOOTP requests
+	reservations  *dhcpdb.Reservations  // Fixed addresses of the clients, nil if disabled
+	bootpPool     *dhcpdb.BootpPool     // Dynamic pool for BOOTP clients, nil if disabled
+	audit         *dhcpdb.AuditLog      // Lease history, nil if disabled
+	degraded      *degradedMode         // Service while Redis is unreachable, nil if disabled
+	ctx           context.Context       // Cancelled on shutdown, parent of the packet contexts
+}
+
+// Reasons sent to the clients into the message option (56) of NAKs
+const (
+	NAK_WRONG_SUBNET  = "requested address not in subnet"
+	NAK_ADDRESS_TAKEN = "requested address already in use"
+	NAK_UNKNOWN_LEASE = "unknown lease"
+	NAK_NOT_ALLOWED   = "client not allowed"
+	NAK_DRAINING      = "requested address being removed from pool"
+	NAK_RESERVED      = "client has a reserved address"
+)
+
+// Minimum interval between two pool reloads triggered by requests for
+// addresses outside of the pool, so that such requests can't flood Redis
+const POOL_RELOAD_INTERVAL = time.Second
+
+// Implemented by the lease stores sharing the pool definition between replicas
+type poolLoader interface {
+	LoadPool(ctx context.Context) error
+	Pool() *dhcpdb.Pool
+}
+
+// Returns the pool definition in use. Pools shared between replicas are
+// replaced when reloaded, so callers keep the returned one for the whole request
+func (h *DHCPHandler) currentPool() *dhcpdb.Pool {
+	if loader, ok := h.store.(poolLoader); ok {
+		return loader.Pool()
+	}
+	return h.pool
 }
 
-func NewHandler(serverIP, startIP, subnet, router, serverDNS *net.IP, leaseRange int, leaseDuration time.Duration, client *redis.Client) *DHCPHandler {
+/*
+Clients retransmit a request after 4 seconds, doubling the delay up to 64
+seconds, randomized by one second (RFC 2131 section 4.1). An answer sent after
+the retransmission is wasted: the client has moved on to the new request.
+*/
+const (
+	RETRANSMIT_FIRST  = 4 * time.Second
+	RETRANSMIT_MAX    = 64 * time.Second
+	RETRANSMIT_JITTER = time.Second
+	MIN_PACKET_TIME   = 500 * time.Millisecond
+)
+
+// Returns the time left to answer a request before the client retransmits it,
+// secs being the seconds elapsed since the client began the exchange
+func packetTime(secs uint16) time.Duration {
+	elapsed := time.Duration(secs) * time.Second
+	next, delay := RETRANSMIT_FIRST, RETRANSMIT_FIRST
+	for next <= elapsed {
+		if delay < RETRANSMIT_MAX {
+			delay *= 2
+		}
+		next += delay
+	}
+
+	if left := next - elapsed - RETRANSMIT_JITTER; left > MIN_PACKET_TIME {
+		return left
+	}
+	return MIN_PACKET_TIME
+}
 
-	sc := dhcpdb.NewSharedContext(client, uint32(leaseRange), startIP, 5)
+// Returns the context of the processing of a packet, expiring when the client
+// is about to retransmit it
+func (h *DHCPHandler) packetContext(p dhcp.Packet) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(h.ctx, packetTime(binary.BigEndian.Uint16(p.Secs())))
+}
 
+func NewHandler(serverIP, subnet, router, serverDNS *net.IP, pool *dhcpdb.Pool, leaseDuration time.Duration, store dhcpdb.LeaseStore) *DHCPHandler {
 	return &DHCPHandler{
+		ctx:           context.Background(),
 		ip:            *serverIP,
 		leaseDuration: leaseDuration,
-		start:         *startIP,
-		leaseRange:    leaseRange,
-		leases:        make(map[int]lease, 10),
+		pool:          pool,
 		options: dhcp.Options{
 			dhcp.OptionSubnetMask:       []byte(*subnet),
 			dhcp.OptionRouter:           []byte(*router),
 			dhcp.OptionDomainNameServer: []byte(*serverDNS),
 		},
-		sc: sc,
+		store:         store,
+		authoritative: true,
+	}
+}
+
+// Returns a NAK carrying the reason in the message option, or nil if the
+// server is not authoritative and the address is not one of ours
+func (h *DHCPHandler) nak(p dhcp.Packet, reason string) dhcp.Packet {
+	if !h.authoritative && (reason == NAK_WRONG_SUBNET || reason == NAK_UNKNOWN_LEASE || reason == NAK_RESERVED) {
+		utils.Log.Printf("Ignoring request from %s: %s\n", p.CHAddr(), reason)
+		return nil
+	}
+
+	utils.Log.Printf("Sending NAK to %s: %s\n", p.CHAddr(), reason)
+
+	return dhcp.ReplyPacket(p, dhcp.NAK, h.ip, nil, 0,
+		[]dhcp.Option{{Code: dhcp.OptionMessage, Value: []byte(reason)}})
+}
+
+// Returns true if the address belongs to the pool and is not excluded. The
+// pool definition is reloaded if another replica may have grown it, at most
+// once per POOL_RELOAD_INTERVAL.
+func (h *DHCPHandler) inPool(ctx context.Context, ipAddr net.IP) bool {
+	if h.degraded != nil && h.degraded.owns(ipAddr) {
+		return true
+	}
+	if isPoolAddress(h.currentPool(), ipAddr) {
+		return true
+	}
+
+	loader, ok := h.store.(poolLoader)
+	if !ok {
+		return false
+	}
+
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&h.poolReloaded)
+	if now-last < int64(POOL_RELOAD_INTERVAL) || !atomic.CompareAndSwapInt64(&h.poolReloaded, last, now) {
+		return false
+	}
+	if err := loader.LoadPool(ctx); err != nil {
+		utils.Log.Println(err)
+		return false
+	}
+
+	return isPoolAddress(loader.Pool(), ipAddr)
+}
+
+// Returns true if the address belongs to the pool and is not excluded
+func isPoolAddress(pool *dhcpdb.Pool, ipAddr net.IP) bool {
+	_, ok := pool.Index(ipAddr)
+	return ok && !pool.Excluded(ipAddr)
+}
+
+// Returns the address reserved to the client, nil if there is none or if it
+// belongs to the DHCP pool, where it could be leased to another client
+func (h *DHCPHandler) reserved(ctx context.Context, hwAddr net.HardwareAddr) *net.IP {
+	if h.reservations == nil {
+		return nil
+	}
+
+	ipAddr, err := h.reservations.Get(ctx, hwAddr)
+	if err != nil {
+		utils.Log.Println(err)
+		return nil
+	}
+	if ipAddr != nil && isPoolAddress(h.currentPool(), *ipAddr) {
+		utils.Log.Printf("Reservation %s - %s ignored, the address belongs to the DHCP pool\n", hwAddr, ipAddr)
+		return nil
+	}
+
+	return ipAddr
+}
+
+// Returns the hardware address bound to the address, from the lease cache if
+// known, nil if the address is not leased
+func (h *DHCPHandler) binding(ctx context.Context, ipAddr net.IP) (*net.HardwareAddr, error) {
+	if h.leases != nil {
+		if hwAddr, ok := h.leases.get(ipAddr); ok {
+			return &hwAddr, nil
+		}
+	}
+
+	hwAddr, err := h.store.GetPortMACMapping(ctx, &ipAddr)
+	if err == nil && hwAddr != nil && h.leases != nil {
+		h.leases.put(ipAddr, *hwAddr, h.leaseDuration)
+	}
+	return hwAddr, err
+}
+
+// Returns the binding of the address while Redis is unreachable: the last one
+// seen by the lease cache as long as its lease lasts, even if no longer
+// trusted, or the one of the local block
+func (h *DHCPHandler) degradedBinding(ctx context.Context, ipAddr net.IP) (*net.HardwareAddr, error) {
+	if h.leases != nil {
+		if hwAddr, ok := h.leases.lastKnown(ipAddr); ok {
+			return &hwAddr, nil
+		}
+	}
+	return h.degraded.binding(ctx, ipAddr)
+}
+
+/*
+Logs an error of the lease store with its class (see dhcpdb.ErrorClass). The
+request is dropped, the client retransmits it.
+*/
+func (h *DHCPHandler) failed(msgType dhcp.MessageType, p dhcp.Packet, err error) {
+	utils.Log.Printf("DHCP %s from %s dropped [%s]: %s\n", msgType, p.CHAddr(), dhcpdb.ErrorClass(err), err)
+}
+
+// Drops the address from the lease cache
+func (h *DHCPHandler) forget(ipAddr net.IP) {
+	if h.leases != nil {
+		h.leases.invalidate(ipAddr.String())
 	}
 }
 
 func (h *DHCPHandler) Close() error {
-	return h.sc.Close()
+	return h.store.Close()
+}
+
+// Returns the relay agent circuit-id and remote-id (option 82) of the request
+func relayIds(options dhcp.Options) []string {
+	var ids []string
+	info := options[dhcp.OptionRelayAgentInformation]
+	for len(info) >= 2 {
+		size := int(info[1])
+		if len(info) < 2+size {
+			break
+		}
+		switch info[0] {
+		case 1:
+			ids = append(ids, "circuit:"+hex.EncodeToString(info[2:2+size]))
+		case 2:
+			ids = append(ids, "remote:"+hex.EncodeToString(info[2:2+size]))
+		}
+		info = info[2+size:]
+	}
+	return ids
+}
+
+// Records a lease event of the client into the lease history
+func (h *DHCPHandler) record(ctx context.Context, eventType string, p dhcp.Packet, options dhcp.Options, ipAddr net.IP, leaseTime time.Duration) {
+	if h.audit == nil {
+		return
+	}
+
+	event := &dhcpdb.AuditEvent{
+		Type:      eventType,
+		IP:        ipAddr.String(),
+		MAC:       p.CHAddr().String(),
+		LeaseTime: leaseTime,
+		ClientID:  hex.EncodeToString(options[dhcp.OptionClientIdentifier]),
+		Hostname:  string(options[dhcp.OptionHostName]),
+		Relay:     relayIds(options),
+	}
+	if giaddr := p.GIAddr(); !giaddr.Equal(net.IPv4zero) {
+		event.GIAddr = giaddr.String()
+	}
+
+	if err := h.audit.Record(ctx, event); err != nil {
+		utils.Log.Println(err)
+	}
+}
+
+// Returns true if the request exceeds the rate limits shared between replicas,
+// newLease if the request may allocate an address
+func (h *DHCPHandler) limited(ctx context.Context, p dhcp.Packet, options dhcp.Options, newLease bool) bool {
+	if h.limiter == nil {
+		return false
+	}
+
+	allowed, reason, err := h.limiter.Allow(ctx, p.CHAddr(), relayIds(options), newLease)
+	if err != nil {
+		utils.Log.Println(err)
+		return false
+	}
+
+	if !allowed {
+		utils.Log.Printf("Request from %s dropped by rate limiter (%s)\n", p.CHAddr(), reason)
+		if err := h.limiter.CountLimited(ctx, reason); err != nil {
+			utils.Log.Println(err)
+		}
+	}
+
+	return !allowed
+}
+
+// Returns true if the client sending the packet is not allowed by the access
+// lists. While Redis is unreachable the lists are skipped, so that degraded
+// mode can keep serving the clients.
+func (h *DHCPHandler) denied(ctx context.Context, p dhcp.Packet, options dhcp.Options) bool {
+	if h.acl == nil {
+		return false
+	}
+
+	allowed, err := h.acl.IsAllowed(ctx, p.CHAddr(), string(options[dhcp.OptionVendorClassIdentifier]))
+	if err != nil {
+		utils.Log.Println(err)
+		return !dhcpdb.IsUnavailable(err)
+	}
+
+	if !allowed {
+		utils.Log.Printf("Client %s denied by access lists\n", p.CHAddr())
+		if err := h.acl.CountDenied(ctx); err != nil {
+			utils.Log.Println(err)
+		}
+	}
+
+	return !allowed
 }
 
 func (h *DHCPHandler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options dhcp.Options) (d dhcp.Packet) {
+	ctx, cancel := h.packetContext(p)
+	defer cancel()
+
+	if (msgType == dhcp.Discover || msgType == dhcp.Request) && h.limited(ctx, p, options, msgType == dhcp.Discover) {
+		return nil
+	}
+
+	if (msgType == dhcp.Discover || msgType == dhcp.Request) && h.denied(ctx, p, options) {
+		if h.nakDenied && msgType == dhcp.Request {
+			return h.nak(p, NAK_NOT_ALLOWED)
+		}
+		return nil
+	}
+
 	switch msgType {
 
 	case dhcp.Discover:
-		free, err := h.sc.GetFirstAvailableAddress()
+		if ipAddr := h.reserved(ctx, p.CHAddr()); ipAddr != nil {
+			utils.Log.Printf("Reserved IP address %s offered to %s\n", ipAddr, p.CHAddr())
+			return dhcp.ReplyPacket(p, dhcp.Offer, h.ip, *ipAddr, h.leaseDuration,
+				h.options.SelectOrderOrAll(options[dhcp.OptionParameterRequestList]))
+		}
+
+		free, err := h.store.GetFirstAvailableAddress(ctx)
+		if h.degraded != nil && dhcpdb.IsUnavailable(err) {
+			free, err = h.degraded.allocate(ctx)
+		}
 		if err != nil {
-			log.Println(err)
+			h.failed(msgType, p, err)
 			return
 		}
 
@@ -85,40 +380,119 @@ func (h *DHCPHandler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options
 
 		utils.Log.Printf("Start processing of request for IP address %s made by %s\n", reqIP, p.CHAddr())
 
-		if len(reqIP) == 4 && !reqIP.Equal(net.IPv4zero) {
-			if leaseNum := dhcp.IPRange(h.start, reqIP) - 1; leaseNum >= 0 && leaseNum < h.leaseRange {
+		if len(reqIP) != 4 || reqIP.Equal(net.IPv4zero) {
+			return h.nak(p, NAK_UNKNOWN_LEASE)
+		}
 
-				hwAddr, err := h.sc.GetPortMACMapping(&reqIP)
-				if err != nil && err != redis.Nil {
-					utils.Log.Println(err)
-					return
-				} else if hwAddr == nil || hwAddr.String() == p.CHAddr().String() {
-					hwAddress := p.CHAddr()
-					err := h.sc.AddIPMACMapping(&reqIP, &hwAddress, h.leaseDuration)
-					if err != nil {
-						utils.Log.Println(err)
-						return
-					}
+		// reserved addresses are outside of the pool, nothing to bind into the store
+		if ipAddr := h.reserved(ctx, p.CHAddr()); ipAddr != nil {
+			if !ipAddr.Equal(reqIP) {
+				return h.nak(p, NAK_RESERVED)
+			}
+			h.record(ctx, dhcpdb.AUDIT_BIND, p, options, reqIP, h.leaseDuration)
+			utils.Log.Printf("Confirmed reserved IP address %s for %s\n", reqIP, p.CHAddr())
+			return dhcp.ReplyPacket(p, dhcp.ACK, h.ip, reqIP, h.leaseDuration,
+				h.options.SelectOrderOrAll(options[dhcp.OptionParameterRequestList]))
+		}
 
-					utils.Log.Printf("Confirmed IP address %s for %s\n", reqIP, p.CHAddr())
+		if !h.inPool(ctx, reqIP) {
+			return h.nak(p, NAK_WRONG_SUBNET)
+		}
 
-					return dhcp.ReplyPacket(p, dhcp.ACK, h.ip, reqIP, h.leaseDuration,
-						h.options.SelectOrderOrAll(options[dhcp.OptionParameterRequestList]))
-				}
+		hwAddr, err := h.binding(ctx, reqIP)
+		if h.degraded != nil && dhcpdb.IsUnavailable(err) {
+			hwAddr, err = h.degradedBinding(ctx, reqIP)
+		}
+		if err != nil {
+			h.failed(msgType, p, err)
+			return
+		} else if hwAddr != nil && hwAddr.String() != p.CHAddr().String() {
+			utils.Log.Printf("IP address %s requested by %s already leased to %s\n", reqIP, p.CHAddr(), hwAddr)
+			return h.nak(p, NAK_ADDRESS_TAKEN)
+		}
+
+		// draining addresses are only renewed by their owner, up to the deadline
+		pool := h.currentPool()
+		leaseDuration := pool.RenewalTime(reqIP, h.leaseDuration)
+		if pool.DrainOf(reqIP) != nil && (hwAddr == nil || leaseDuration == 0) {
+			return h.nak(p, NAK_DRAINING)
+		}
+
+		hwAddress := p.CHAddr()
+		if hwAddr != nil {
+			err = h.store.RenewIPMACMapping(ctx, &reqIP, &hwAddress, leaseDuration)
+		}
+		// the lease may have expired since the lookup, the client gets it back if still free
+		if hwAddr == nil || errors.Is(err, dhcpdb.ErrNotFound) {
+			err = h.store.AddIPMACMapping(ctx, &reqIP, &hwAddress, leaseDuration)
+		}
+		if h.degraded != nil && dhcpdb.IsUnavailable(err) {
+			if hwAddr != nil {
+				err = h.degraded.bind(ctx, WRITE_RENEW, reqIP, hwAddress, leaseDuration)
+			} else {
+				err = h.degraded.bind(ctx, WRITE_BIND, reqIP, hwAddress, leaseDuration)
+			}
+		}
+		if errors.Is(err, dhcpdb.ErrConflict) {
+			utils.Log.Println(err)
+			h.forget(reqIP)
+			return h.nak(p, NAK_ADDRESS_TAKEN)
+		} else if err != nil {
+			h.failed(msgType, p, err)
+			h.forget(reqIP)
+			return
+		}
+		if h.leases != nil {
+			h.leases.put(reqIP, hwAddress, leaseDuration)
+		}
 
+		if h.limiter != nil {
+			if err := h.limiter.TrackLease(ctx, relayIds(options), &reqIP, leaseDuration); err != nil {
+				utils.Log.Println(err)
 			}
 		}
-		return dhcp.ReplyPacket(p, dhcp.NAK, h.ip, nil, 0, nil)
+
+		if hwAddr != nil {
+			h.record(ctx, dhcpdb.AUDIT_RENEW, p, options, reqIP, leaseDuration)
+		} else {
+			h.record(ctx, dhcpdb.AUDIT_BIND, p, options, reqIP, leaseDuration)
+		}
+
+		utils.Log.Printf("Confirmed IP address %s for %s\n", reqIP, p.CHAddr())
+
+		return dhcp.ReplyPacket(p, dhcp.ACK, h.ip, reqIP, leaseDuration,
+			h.options.SelectOrderOrAll(options[dhcp.OptionParameterRequestList]))
 
 	case dhcp.Release, dhcp.Decline:
+		// a DECLINE carries the address in the requested address option, ciaddr is zero
 		ipAddress := p.CIAddr()
+		if declined := net.IP(options[dhcp.OptionRequestedIPAddress]); msgType == dhcp.Decline && len(declined) == net.IPv4len {
+			ipAddress = declined
+		}
 		hwAddress := p.CHAddr()
 
 		utils.Log.Printf("Incoming DHCP Release/Decline from %s [ip: %s]\n", hwAddress, ipAddress)
 
-		if err := h.sc.RemoveIPMapping(&ipAddress, &hwAddress); err != nil {
+		err := h.store.RemoveIPMapping(ctx, &ipAddress, &hwAddress)
+		if h.degraded != nil && dhcpdb.IsUnavailable(err) {
+			err = h.degraded.release(ctx, ipAddress, hwAddress)
+		}
+		if err != nil {
 			utils.Log.Println(err)
 		}
+		h.forget(ipAddress)
+
+		if h.limiter != nil {
+			if err := h.limiter.ForgetLease(ctx, relayIds(options), &ipAddress); err != nil {
+				utils.Log.Println(err)
+			}
+		}
+
+		if msgType == dhcp.Decline {
+			h.record(ctx, dhcpdb.AUDIT_DECLINE, p, options, ipAddress, 0)
+		} else {
+			h.record(ctx, dhcpdb.AUDIT_RELEASE, p, options, ipAddress, 0)
+		}
 
 		utils.Log.Printf("Mapping %s - %s released\n", hwAddress, ipAddress)
 
@@ -126,6 +500,54 @@ func (h *DHCPHandler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options
 	return nil
 }
 
+// Answers to a BOOTREQUEST without DHCP message type, assigning the address reserved
+// to the client or one from the dynamic BOOTP pool
+func (h *DHCPHandler) ServeBOOTP(p dhcp.Packet, options dhcp.Options) dhcp.Packet {
+	if !h.bootpMode {
+		return nil
+	}
+
+	ctx, cancel := h.packetContext(p)
+	defer cancel()
+
+	hwAddr := p.CHAddr()
+	utils.Log.Printf("Incoming BOOTP request from %s\n", hwAddr)
+
+	if h.limited(ctx, p, options, true) || h.denied(ctx, p, options) {
+		return nil
+	}
+
+	var err error
+	ipAddr := h.reserved(ctx, hwAddr)
+	if ipAddr == nil && h.bootpPool != nil {
+		if ipAddr, err = h.bootpPool.Assign(ctx, hwAddr); err != nil {
+			utils.Log.Println(err)
+			return nil
+		}
+	}
+
+	if ipAddr == nil {
+		utils.Log.Printf("No BOOTP address available for %s\n", hwAddr)
+		return nil
+	}
+
+	res := dhcp.NewPacket(dhcp.BootReply)
+	res.SetXId(p.XId())
+	res.SetFlags(p.Flags())
+	res.SetYIAddr(*ipAddr)
+	res.SetSIAddr(h.ip)
+	res.SetGIAddr(p.GIAddr())
+	res.SetCHAddr(hwAddr)
+	for _, o := range h.options.SelectOrderOrAll(nil) {
+		res.AddOption(o.Code, o.Value)
+	}
+	res.PadToMinSize()
+
+	utils.Log.Printf("BOOTP address %s assigned to %s\n", ipAddr, hwAddr)
+
+	return res
+}
+
 type SFServerConn struct {
 	inConn  *net.UDPConn
 	outConn *ipv4.PacketConn
@@ -178,16 +600,20 @@ func (a *SFAddress) String() string {
 
 var terminateSignal int = len([]byte("terminate"))
 
+// Returned by the connection once the terminate signal is received
+var errTerminated = errors.New("terminated")
+
 func (s *SFServerConn) ReadFrom(b []byte) (int, net.Addr, error) {
 	buff := make([]byte, 65535)
 	size, err := s.inConn.Read(buff)
 	if err != nil {
 		utils.Log.Printf("Error reading incoming message from UDP socket: %s\n", err)
+		return 0, nil, err
 	}
 
 	if size == terminateSignal && string(buff[:size]) == "terminate" {
 		utils.Log.Printf("Received terminate signal")
-		os.Exit(0)
+		return 0, nil, errTerminated
 	}
 
 	ipPkt := header.IPv4(buff[:size])
@@ -205,7 +631,7 @@ func (s *SFServerConn) Close() error {
 	}
 
 	if err := s.outConn.Close(); err != nil {
-		errStr = fmt.Sprintf("%sError closing outgoing connection: %s\n", err)
+		errStr = fmt.Sprintf("%sError closing outgoing connection: %s\n", errStr, err)
 	}
 
 	return fmt.Errorf(errStr)
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"dhcpdb"
+	"utils"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+var (
+	testServerIP = net.IPv4(10, 0, 0, 1).To4()
+	testMAC      = net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}
+	otherMAC     = net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x66}
+)
+
+func TestMain(m *testing.M) {
+	utils.Log = log.New(ioutil.Discard, "", 0)
+	os.Exit(m.Run())
+}
+
+// returns a handler serving 10.0.0.10-10.0.0.12 from a MemStore, with the
+// addresses of bound already leased to the hardware addresses
+func newTestHandler(t *testing.T, bound map[string]net.HardwareAddr) (*DHCPHandler, *dhcpdb.MemStore) {
+	mask := net.IPv4Mask(255, 255, 255, 0)
+	pool, err := dhcpdb.NewPool([]string{"10.0.0.10-10.0.0.12"}, nil, mask)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := dhcpdb.NewMemStore(pool)
+	for ip, hwAddr := range bound {
+		ipAddr := net.ParseIP(ip).To4()
+		if err := store.AddIPMACMapping(context.Background(), &ipAddr, &hwAddr, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	serverIP, subnet := testServerIP, net.IP(mask)
+	router, dns := net.IPv4(10, 0, 0, 2).To4(), net.IPv4(10, 0, 0, 3).To4()
+	return NewHandler(&serverIP, &subnet, &router, &dns, pool, time.Hour, store), store
+}
+
+// returns the hardware address the address is leased to, nil if none
+func boundTo(t *testing.T, store dhcpdb.LeaseStore, ip string) net.HardwareAddr {
+	ipAddr := net.ParseIP(ip).To4()
+	hwAddr, err := store.GetPortMACMapping(context.Background(), &ipAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hwAddr == nil {
+		return nil
+	}
+	return *hwAddr
+}
+
+// runs the request through the handler, returning the reply and its type
+func serve(h *DHCPHandler, req dhcp.Packet) (dhcp.Packet, dhcp.MessageType) {
+	options := req.ParseOptions()
+	res := h.ServeDHCP(req, dhcp.MessageType(options[dhcp.OptionDHCPMessageType][0]), options)
+	if res == nil {
+		return nil, 0
+	}
+	return res, dhcp.MessageType(res.ParseOptions()[dhcp.OptionDHCPMessageType][0])
+}
+
+func TestPacketTime(t *testing.T) {
+	tests := []struct {
+		secs uint16
+		want time.Duration
+	}{
+		{secs: 0, want: 3 * time.Second},
+		{secs: 2, want: time.Second},
+		{secs: 3, want: MIN_PACKET_TIME},
+		{secs: 4, want: 7 * time.Second},
+		{secs: 10, want: time.Second},
+		{secs: 12, want: 15 * time.Second},
+		{secs: 60, want: 63 * time.Second},
+		{secs: 130, want: 57 * time.Second},
+		{secs: 65535, want: 60 * time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := packetTime(tt.secs); got != tt.want {
+			t.Errorf("packetTime(%d) = %s, want %s", tt.secs, got, tt.want)
+		}
+	}
+}
+
+func TestServeDHCPDiscover(t *testing.T) {
+	tests := []struct {
+		name  string
+		bound map[string]net.HardwareAddr
+		want  net.IP // nil if no offer is expected
+	}{
+		{name: "first address", want: net.IPv4(10, 0, 0, 10)},
+		{name: "bound address skipped", bound: map[string]net.HardwareAddr{"10.0.0.10": otherMAC}, want: net.IPv4(10, 0, 0, 11)},
+		{name: "pool exhausted", bound: map[string]net.HardwareAddr{
+			"10.0.0.10": otherMAC, "10.0.0.11": otherMAC, "10.0.0.12": otherMAC,
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := newTestHandler(t, tt.bound)
+			res, msgType := serve(h, dhcp.RequestPacket(dhcp.Discover, testMAC, nil, []byte{1, 2, 3, 4}, false, nil))
+
+			if tt.want == nil {
+				if res != nil {
+					t.Fatalf("reply %s for %s, want none", msgType, res.YIAddr())
+				}
+				return
+			}
+			if msgType != dhcp.Offer {
+				t.Fatalf("reply %s, want %s", msgType, dhcp.Offer)
+			}
+			if !res.YIAddr().Equal(tt.want) {
+				t.Errorf("offered %s, want %s", res.YIAddr(), tt.want)
+			}
+			if id := net.IP(res.ParseOptions()[dhcp.OptionServerIdentifier]); !id.Equal(testServerIP) {
+				t.Errorf("server identifier %s, want %s", id, testServerIP)
+			}
+		})
+	}
+}
+
+func TestServeDHCPRequest(t *testing.T) {
+	tests := []struct {
+		name      string
+		bound     map[string]net.HardwareAddr
+		ciaddr    net.IP
+		requested net.IP
+		serverID  net.IP
+		want      dhcp.MessageType // 0 if no reply is expected
+		wantNak   string
+		wantBound net.HardwareAddr // owner of 10.0.0.10 after the request
+	}{
+		{
+			name:      "new binding",
+			requested: net.IPv4(10, 0, 0, 10),
+			serverID:  testServerIP,
+			want:      dhcp.ACK,
+			wantBound: testMAC,
+		},
+		{
+			name:      "init-reboot",
+			requested: net.IPv4(10, 0, 0, 10),
+			want:      dhcp.ACK,
+			wantBound: testMAC,
+		},
+		{
+			name:      "other server selected",
+			requested: net.IPv4(10, 0, 0, 10),
+			serverID:  net.IPv4(10, 0, 0, 99),
+		},
+		{
+			name:      "renew",
+			bound:     map[string]net.HardwareAddr{"10.0.0.10": testMAC},
+			ciaddr:    net.IPv4(10, 0, 0, 10),
+			want:      dhcp.ACK,
+			wantBound: testMAC,
+		},
+		{
+			name:      "address taken",
+			bound:     map[string]net.HardwareAddr{"10.0.0.10": otherMAC},
+			requested: net.IPv4(10, 0, 0, 10),
+			want:      dhcp.NAK,
+			wantNak:   NAK_ADDRESS_TAKEN,
+			wantBound: otherMAC,
+		},
+		{
+			name:      "wrong subnet",
+			requested: net.IPv4(192, 168, 0, 10),
+			want:      dhcp.NAK,
+			wantNak:   NAK_WRONG_SUBNET,
+		},
+		{
+			name:    "no address",
+			want:    dhcp.NAK,
+			wantNak: NAK_UNKNOWN_LEASE,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, store := newTestHandler(t, tt.bound)
+
+			var options []dhcp.Option
+			if tt.requested != nil {
+				options = append(options, dhcp.Option{Code: dhcp.OptionRequestedIPAddress, Value: tt.requested.To4()})
+			}
+			if tt.serverID != nil {
+				options = append(options, dhcp.Option{Code: dhcp.OptionServerIdentifier, Value: tt.serverID.To4()})
+			}
+			res, msgType := serve(h, dhcp.RequestPacket(dhcp.Request, testMAC, tt.ciaddr, []byte{1, 2, 3, 4}, false, options))
+
+			if msgType != tt.want {
+				t.Fatalf("reply %v, want %v", msgType, tt.want)
+			}
+			if tt.want == dhcp.NAK {
+				if msg := string(res.ParseOptions()[dhcp.OptionMessage]); msg != tt.wantNak {
+					t.Errorf("NAK message %q, want %q", msg, tt.wantNak)
+				}
+			}
+			if hwAddr := boundTo(t, store, "10.0.0.10"); hwAddr.String() != tt.wantBound.String() {
+				t.Errorf("10.0.0.10 bound to %q, want %q", hwAddr, tt.wantBound)
+			}
+
+			if tt.want == dhcp.ACK {
+				// bindings and renewals last the lease duration of the handler
+				err := store.ForEachMapping(context.Background(), func(l *dhcpdb.Lease) error {
+					if left := time.Until(l.Expiry); left < 59*time.Minute || left > time.Hour {
+						t.Errorf("lease of %s ends in %s, want %s", l.IP, left, time.Hour)
+					}
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestServeDHCPRelease(t *testing.T) {
+	tests := []struct {
+		name      string
+		msgType   dhcp.MessageType
+		hwAddr    net.HardwareAddr
+		ciaddr    net.IP
+		requested net.IP
+		wantBound net.HardwareAddr // owner of 10.0.0.10 after the message
+	}{
+		{name: "release", msgType: dhcp.Release, hwAddr: testMAC, ciaddr: net.IPv4(10, 0, 0, 10)},
+		{name: "release by another client", msgType: dhcp.Release, hwAddr: otherMAC, ciaddr: net.IPv4(10, 0, 0, 10), wantBound: testMAC},
+		{name: "decline", msgType: dhcp.Decline, hwAddr: testMAC, requested: net.IPv4(10, 0, 0, 10)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, store := newTestHandler(t, map[string]net.HardwareAddr{"10.0.0.10": testMAC})
+
+			var options []dhcp.Option
+			if tt.requested != nil {
+				options = append(options, dhcp.Option{Code: dhcp.OptionRequestedIPAddress, Value: tt.requested.To4()})
+			}
+			if res, msgType := serve(h, dhcp.RequestPacket(tt.msgType, tt.hwAddr, tt.ciaddr, []byte{1, 2, 3, 4}, false, options)); res != nil {
+				t.Fatalf("reply %s, want none", msgType)
+			}
+
+			if hwAddr := boundTo(t, store, "10.0.0.10"); hwAddr.String() != tt.wantBound.String() {
+				t.Errorf("10.0.0.10 bound to %q, want %q", hwAddr, tt.wantBound)
+			}
+		})
+	}
+}
+
+func TestServeDHCPReservation(t *testing.T) {
+	tests := []struct {
+		name      string
+		reserved  net.IP
+		msgType   dhcp.MessageType
+		requested net.IP
+		want      dhcp.MessageType
+		wantIP    net.IP
+		wantNak   string
+	}{
+		{name: "discover", reserved: net.IPv4(10, 0, 0, 50), msgType: dhcp.Discover, want: dhcp.Offer, wantIP: net.IPv4(10, 0, 0, 50)},
+		{name: "request", reserved: net.IPv4(10, 0, 0, 50), msgType: dhcp.Request, requested: net.IPv4(10, 0, 0, 50), want: dhcp.ACK, wantIP: net.IPv4(10, 0, 0, 50)},
+		{name: "request of another address", reserved: net.IPv4(10, 0, 0, 50), msgType: dhcp.Request, requested: net.IPv4(10, 0, 0, 10), want: dhcp.NAK, wantNak: NAK_RESERVED},
+		{name: "reservation inside the pool", reserved: net.IPv4(10, 0, 0, 11), msgType: dhcp.Discover, want: dhcp.Offer, wantIP: net.IPv4(10, 0, 0, 10)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mr := miniredis.RunT(t)
+			client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+			defer client.Close()
+
+			h, store := newTestHandler(t, nil)
+			h.reservations = dhcpdb.NewReservations(client, dhcpdb.NewKeyspace("test"))
+			if err := h.reservations.Add(context.Background(), testMAC, tt.reserved); err != nil {
+				t.Fatal(err)
+			}
+
+			var options []dhcp.Option
+			if tt.requested != nil {
+				options = append(options, dhcp.Option{Code: dhcp.OptionRequestedIPAddress, Value: tt.requested.To4()})
+			}
+			res, msgType := serve(h, dhcp.RequestPacket(tt.msgType, testMAC, nil, []byte{1, 2, 3, 4}, false, options))
+
+			if msgType != tt.want {
+				t.Fatalf("reply %v, want %v", msgType, tt.want)
+			}
+			if tt.want == dhcp.NAK {
+				if msg := string(res.ParseOptions()[dhcp.OptionMessage]); msg != tt.wantNak {
+					t.Errorf("NAK message %q, want %q", msg, tt.wantNak)
+				}
+				return
+			}
+			if !res.YIAddr().Equal(tt.wantIP) {
+				t.Errorf("address %s, want %s", res.YIAddr(), tt.wantIP)
+			}
+			// reserved addresses are never bound into the pool
+			if hwAddr := boundTo(t, store, "10.0.0.10"); hwAddr != nil {
+				t.Errorf("10.0.0.10 bound to %s, want none", hwAddr)
+			}
+		})
+	}
+}